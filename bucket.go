@@ -2,53 +2,69 @@ package iodb
 
 import (
 	"archive/tar"
+	"context"
 	"io"
 	"log"
+	"math"
 	"math/big"
 	"os"
 	"path/filepath"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alpineiq/iodb/mw"
-	"go.oneofone.dev/genh"
 	"go.oneofone.dev/oerrs"
 )
 
 type bucket struct {
 	files   *files
 	db      *DB
-	keys    keyList
+	parent  *bucket
+	keys    *keyList
 	buckets buckets
 	meta    *metadata
 	name    string
 	path    string
 	mux     sync.RWMutex
+	opened  atomic.Bool // loaded at least once
+	layout  Layout      // set by the first load
+
+	onExpire   ExpireFunc
+	retryAfter time.Duration
 }
 
-func newBucket(name, parentPath string, db *DB) (b *bucket, err error) {
+// newBucket opens or creates a bucket, parent is nil for the root bucket.
+func newBucket(parent *bucket, name, parentPath string, db *DB) (b *bucket, err error) {
 	path := filepath.Join(parentPath, db.encodeKey(name))
-	if err = os.MkdirAll(path, 0o755); err != nil {
+	if err = db.fs.MkdirAll(path, 0o755); err != nil {
 		return nil, err
 	}
-	b = &bucket{
-		name: name,
-		path: path,
-		db:   db,
-
-		files: newFiles(),
+	b = openBucket(parent, name, path, db)
+	if db.opts.LazyLoad {
+		return b, nil
 	}
 
-	if b.meta, err = loadMetadata(b.path); err != nil {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if err = b.loadLocked(); err != nil {
 		return nil, err
 	}
+	db.resident.loaded(b)
+	return
+}
 
-	if err = b.reload(); err != nil {
-		b = nil
-	}
+// openBucket returns a bucket that gets loaded on its first access.
+func openBucket(parent *bucket, name, path string, db *DB) *bucket {
+	return &bucket{
+		name:    name,
+		path:    path,
+		db:      db,
+		parent:  parent,
+		buckets: buckets{},
 
-	return
+		files: newFiles(db.fs, db.ops),
+	}
 }
 
 func (b *bucket) Name() string {
@@ -63,7 +79,10 @@ func (b *bucket) Bucket(names ...string) Bucket {
 	if len(names) == 0 {
 		return b
 	}
-	b.mux.RLock()
+	if err := b.rlock(); err != nil {
+		b.logErr("Bucket", err)
+		return nil
+	}
 	defer b.mux.RUnlock()
 	var cb *bucket
 	if cb = b.buckets[names[0]]; cb != nil {
@@ -77,16 +96,26 @@ func (b *bucket) Bucket(names ...string) Bucket {
 }
 
 func (b *bucket) CreateBucket(names ...string) (_ Bucket, err error) {
+	defer b.wrapErr("CreateBucket", "", &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
 	if len(names) == 0 {
 		return b, nil
 	}
 	var ok bool
 	name := names[0]
-	b.mux.Lock()
+	if err = b.db.checkName(name); err != nil {
+		return
+	}
+	if err = b.lock(); err != nil {
+		return
+	}
 	defer b.mux.Unlock()
 	var cb *bucket
 	if cb, ok = b.buckets[name]; !ok {
-		if cb, err = newBucket(name, b.path, b.db); err == nil {
+		if cb, err = newBucket(b, name, b.path, b.db); err == nil {
 			b.buckets[name] = cb
 		} else {
 			return
@@ -100,52 +129,190 @@ func (b *bucket) CreateBucket(names ...string) (_ Bucket, err error) {
 }
 
 func (b *bucket) DeleteBucket(name string) (err error) {
-	b.mux.Lock()
-	if cb, ok := b.buckets[name]; ok {
+	defer b.wrapErr("DeleteBucket", "", &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	cb, ok := b.buckets[name]
+	if ok {
 		delete(b.buckets, name)
-		err = os.RemoveAll(cb.path)
+		b.meta.SetBucketDeleted(name)
+		err = b.db.fs.RemoveAll(cb.path)
 	} else {
-		err = os.ErrNotExist
+		err = ErrNotFound
+	}
+	b.unlockWrite()
+	if ok {
+		cb.forget()
+	}
+	if err == nil {
+		err = b.db.fsyncDir(b.path)
 	}
-	b.mux.Unlock()
 	return
 }
 
 // Get returns an io.ReadCloser, it is the caller's responsibility to close the reader.
-func (b *bucket) Get(key string, middlewares ...mw.Middleware) (_ io.ReadCloser, err error) {
-	b.mux.RLock()
-	fi, ok := b.keys[key]
+func (b *bucket) Get(key string, middlewares ...mw.Middleware) (io.ReadCloser, error) {
+	return b.GetContext(context.Background(), key, middlewares...)
+}
+
+// GetContext is Get, but it gives up waiting for a writer of the key once ctx is done,
+// and reading from the returned reader fails with ctx.Err() after that.
+func (b *bucket) GetContext(ctx context.Context, key string, middlewares ...mw.Middleware) (_ io.ReadCloser, err error) {
+	defer b.wrapErr("Get", key, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.db.checkKey(key); err != nil {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = b.rlockContext(ctx); err != nil {
+		return
+	}
+	fi, ok := b.keys.Get(key)
+	sliding := time.Duration(b.meta.Sliding[key])
 	b.mux.RUnlock()
 	if !ok {
-		return nil, os.ErrNotExist
+		return nil, ErrNotFound
+	}
+	if sliding > 0 {
+		if err = b.slideExpiry(key, sliding); err != nil {
+			return
+		}
 	}
 	var (
 		rd   *Reader
+		rc   io.ReadCloser
+		l    *rwlock
 		fn   = fi.Name()
-		path = filepath.Join(b.path, fn)
+		path = b.filePath(fn)
 	)
 
-	defer b.db.lk.RLock(path).RUnlock()
+	if l, err = b.db.lk.RLockContext(ctx, path); err != nil {
+		return
+	}
+	defer l.RUnlock()
 	if rd, err = b.files.Get(path); err != nil {
 		return
 	}
 
-	return middlewareList(middlewares).applyReaders(fn, rd)
+	if rc, err = middlewareList(middlewares).applyReaders(fn, rd); err != nil {
+		return
+	}
+	return readCloserWithContext(ctx, rc), nil
 }
 
-func (b *bucket) PutTimedFunc(key string, fn func(w io.Writer) error, expireAfter time.Duration, middlewares ...mw.Middleware) (err error) {
+// GetRange returns a reader for n bytes of the value starting at off, n < 0 reads until the end.
+// If the value (or the last middleware) supports io.ReaderAt, the returned reader supports
+// io.ReaderAt and io.Seeker relative to the range, otherwise the first off bytes are skipped.
+// It is the caller's responsibility to close the reader.
+func (b *bucket) GetRange(key string, off, n int64, middlewares ...mw.Middleware) (_ io.ReadCloser, err error) {
+	defer b.wrapErr("GetRange", key, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.db.checkKey(key); err != nil {
+		return
+	}
+	if off < 0 {
+		return nil, ErrNegativeOffset
+	}
+
+	var rc io.ReadCloser
+	if rc, err = b.Get(key, middlewares...); err != nil {
+		return
+	}
+
+	if n < 0 {
+		n = math.MaxInt64 - off
+	}
+
+	if ra, ok := asReaderAt(rc); ok {
+		return &rangeReader{io.NewSectionReader(ra, off, n), rc}, nil
+	}
+
+	if _, err = io.CopyN(io.Discard, rc, off); err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+
+	return &rangeReader{io.LimitReader(rc, n), rc}, nil
+}
+
+type rangeReader struct {
+	io.Reader
+	io.Closer
+}
+
+func (rr *rangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if ra, ok := rr.Reader.(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+	return 0, ErrNotSeekable
+}
+
+func (rr *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := rr.Reader.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, ErrNotSeekable
+}
+
+func (b *bucket) PutTimedFunc(key string, fn func(w io.Writer) error, expireAfter time.Duration, middlewares ...mw.Middleware) error {
+	return b.putTimedFunc(context.Background(), key, fn, expireAfter, middlewares...)
+}
+
+// PutContext is Put, but it gives up waiting for other writers of the key and stops copying r once ctx is done,
+// the key is left untouched if that happens.
+func (b *bucket) PutContext(ctx context.Context, key string, r io.Reader, middlewares ...mw.Middleware) error {
+	fn := func(w io.Writer) error { _, err := io.Copy(w, withContext(ctx, r)); return err }
+	return b.putTimedFunc(ctx, key, fn, 0, middlewares...)
+}
+
+func (b *bucket) putTimedFunc(ctx context.Context, key string, fn func(w io.Writer) error, expireAfter time.Duration, middlewares ...mw.Middleware) (err error) {
+	defer b.wrapErr("Put", key, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.db.checkKey(key); err != nil {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
 	var (
-		encKey  = b.db.encodeKey(key)
-		path    = filepath.Join(b.path, encKey)
-		tmpPath = tmpFileName(path)
-		f       *os.File
+		encKey = b.db.keyFileName(key)
+		path   string
+		f      File
+		l      *rwlock
 	)
-	defer b.db.lk.Lock(path).Unlock()
+	if path, err = b.prepareFile(encKey); err != nil {
+		return
+	}
+	tmpPath := tmpFileName(path)
+	if l, err = b.db.lk.LockContext(ctx, path); err != nil {
+		return
+	}
+	defer l.Unlock()
 
-	if f, err = os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644); err != nil {
+	if f, err = b.db.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644); err != nil {
 		return
 	}
-	defer os.Remove(tmpPath) // this will error if os.Rename doesn't fail, which is fine
+	defer b.db.fs.Remove(tmpPath) // this will error if os.Rename doesn't fail, which is fine
+
+	if b.db.opts.SyncMode >= SyncData {
+		f = syncCloser{f}
+	}
 
 	var wc io.WriteCloser
 	if wc, err = middlewareList(middlewares).applyWriters(path, f); err != nil {
@@ -161,35 +328,65 @@ func (b *bucket) PutTimedFunc(key string, fn func(w io.Writer) error, expireAfte
 		return
 	}
 
-	b.mux.Lock()
-	defer b.mux.Unlock()
-	if err = os.Rename(tmpPath, path); err != nil {
+	if err = b.commitFile(ctx, key, tmpPath, path, expireAfter); err != nil {
+		return
+	}
+	return b.db.fsyncDirs(filepath.Dir(path), b.path)
+}
+
+// commitFile renames a fully written src to path and registers it as key, unless ctx is done first.
+// the caller must hold the path lock and call DB.fsyncDir after.
+func (b *bucket) commitFile(ctx context.Context, key, src, path string, expireAfter time.Duration) (err error) {
+	if err = b.lockWriteContext(ctx); err != nil {
+		return
+	}
+	defer b.unlockWrite()
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = b.db.fs.Rename(src, path); err != nil {
 		return
 	}
 	var st os.FileInfo
-	if st, err = os.Stat(path); err != nil {
+	if st, err = b.db.fs.Stat(path); err != nil {
 		return
 	}
-	if _, ok := b.keys[key]; !ok { // only increase the counter if new files
+	if _, ok := b.keys.Get(key); !ok { // only increase the counter if new files
 		b.meta.incCounter()
 	}
-	b.keys[key] = st
-	if expireAfter > 0 {
-		b.meta.SetExpiryDate(key, time.Now().Add(expireAfter).Unix())
-		ts := st.ModTime()
-		time.AfterFunc(expireAfter, func() { b.deleteTimed(key, ts) })
-	} else {
-		b.meta.SetExpiryDate(key, 0) // this is needed in case you changed the expiry.
+	b.setKey(key, st)
+	b.setExpiry(key, b.putTTL(expireAfter)) // this is needed in case you changed the expiry.
+	b.meta.SetChanged(key)
+	return b.meta.store()
+}
+
+// setExpiry must be called with b.mux held, expireAfter <= 0 removes the expiry.
+func (b *bucket) setExpiry(key string, expireAfter time.Duration) {
+	if expireAfter <= 0 {
+		b.setExpiryAt(key, time.Time{})
+		return
 	}
-	err = b.meta.store()
+	b.setExpiryAt(key, time.Now().Add(expireAfter))
+}
 
-	return
+// setExpiryAt must be called with b.mux held, a zero at removes the expiry.
+// it also turns off sliding expiry, ExpireSliding turns it back on.
+func (b *bucket) setExpiryAt(key string, at time.Time) {
+	b.meta.SetSliding(key, 0)
+	if at.IsZero() {
+		b.meta.SetExpiryDate(key, 0)
+		b.db.expiry.Cancel(b, key)
+		return
+	}
+	b.meta.SetExpiryDate(key, at.Unix())
+	b.db.expiry.Schedule(at, b, key)
 }
 
 func (b *bucket) PutFunc(key string, fn func(w io.Writer) error, middlewares ...mw.Middleware) (err error) {
 	return b.PutTimedFunc(key, fn, 0, middlewares...)
 }
 
+// PutTimed is Put with an expiry, 0 uses the bucket's default TTL and NoTTL stores the key without one.
 func (b *bucket) PutTimed(key string, r io.Reader, expireAfter time.Duration, middlewares ...mw.Middleware) (err error) {
 	fn := func(w io.Writer) error { _, err := io.Copy(w, r); return err }
 	return b.PutTimedFunc(key, fn, expireAfter, middlewares...)
@@ -205,18 +402,54 @@ func (b *bucket) Append(key string, r io.Reader, middlewares ...mw.Middleware) (
 	return b.AppendFunc(key, fn, middlewares...)
 }
 
-func (b *bucket) AppendFunc(key string, fn func(w io.Writer) error, middlewares ...mw.Middleware) (err error) {
+func (b *bucket) AppendFunc(key string, fn func(w io.Writer) error, middlewares ...mw.Middleware) error {
+	return b.appendFunc(context.Background(), key, fn, middlewares...)
+}
+
+// AppendContext is Append, but it gives up waiting for other writers of the key and stops copying r once ctx is done,
+// like any other error while copying, that can leave part of r appended.
+func (b *bucket) AppendContext(ctx context.Context, key string, r io.Reader, middlewares ...mw.Middleware) error {
+	fn := func(w io.Writer) error { _, err := io.Copy(w, withContext(ctx, r)); return err }
+	return b.appendFunc(ctx, key, fn, middlewares...)
+}
+
+func (b *bucket) appendFunc(ctx context.Context, key string, fn func(w io.Writer) error, middlewares ...mw.Middleware) (err error) {
+	defer b.wrapErr("Append", key, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.db.checkKey(key); err != nil {
+		return
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	if err = middlewareList(middlewares).checkAppend(); err != nil {
+		return
+	}
 	var (
-		encKey = b.db.encodeKey(key)
-		path   = filepath.Join(b.path, encKey)
-		f      *os.File
+		encKey = b.db.keyFileName(key)
+		path   string
+		f      File
 		wc     io.WriteCloser
+		l      *rwlock
 	)
-	defer b.db.lk.Lock(path).Unlock()
-	if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
+	if path, err = b.prepareFile(encKey); err != nil {
+		return
+	}
+	if l, err = b.db.lk.LockContext(ctx, path); err != nil {
+		return
+	}
+	defer l.Unlock()
+	if f, err = b.db.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
 		return
 	}
 
+	if b.db.opts.SyncMode >= SyncData {
+		f = syncCloser{f}
+	}
+
 	if wc, err = middlewareList(middlewares).applyWriters(path, f); err != nil {
 		return
 	}
@@ -230,36 +463,56 @@ func (b *bucket) AppendFunc(key string, fn func(w io.Writer) error, middlewares
 		return
 	}
 
-	b.mux.Lock()
-	defer b.mux.Unlock()
-	if _, ok := b.keys[key]; !ok { // only increase the counter if new files
-		b.meta.incCounter()
-	}
+	if err = func() (err error) {
+		// the data is already appended, so ctx can't stop it from being registered anymore.
+		if err = b.lockWrite(); err != nil {
+			return
+		}
+		defer b.unlockWrite()
+		if _, ok := b.keys.Get(key); !ok { // only increase the counter if new files
+			b.meta.incCounter()
+		}
 
-	var st os.FileInfo
+		var st os.FileInfo
 
-	if st, err = os.Stat(path); err != nil {
+		if st, err = b.db.fs.Stat(path); err != nil {
+			return
+		}
+
+		b.setKey(key, st)
+		b.setExpiry(key, b.putTTL(0))
+		b.meta.SetChanged(key)
+
+		return b.meta.store()
+	}(); err != nil {
 		return
 	}
 
-	b.keys[key] = st
-	b.meta.SetExpiryDate(key, 0)
-
-	return b.meta.store()
+	return b.db.fsyncDirs(filepath.Dir(path), b.path)
 }
 
 func (b *bucket) GetAndDelete(key string, fn func(r io.Reader) error, middlewares ...mw.Middleware) (err error) {
-	b.mux.RLock()
-	fi, ok := b.keys[key]
+	defer b.wrapErr("GetAndDelete", key, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.db.checkKey(key); err != nil {
+		return
+	}
+	if err = b.rlock(); err != nil {
+		return
+	}
+	fi, ok := b.keys.Get(key)
 	b.mux.RUnlock()
 
 	if !ok {
-		return os.ErrNotExist
+		return ErrNotFound
 	}
 	var (
 		rd    *Reader
 		fname = fi.Name()
-		path  = filepath.Join(b.path, fname)
+		path  = b.filePath(fname)
 		rc    io.ReadCloser
 	)
 
@@ -279,12 +532,20 @@ func (b *bucket) GetAndDelete(key string, fn func(r io.Reader) error, middleware
 	}
 	rc.Close()
 
-	b.mux.Lock()
-	err = os.Remove(path)
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	err = b.db.fs.Remove(path)
 	b.nukeKey(key)
 	b.files.Delete(path)
-	b.mux.Unlock()
+	if err == nil {
+		err = b.meta.store()
+	}
+	b.unlockWrite()
 
+	if err == nil {
+		err = b.db.fsyncDirs(filepath.Dir(path), b.path)
+	}
 	return
 }
 
@@ -292,18 +553,31 @@ func (b *bucket) GetAndDelete(key string, fn func(r io.Reader) error, middleware
 type ReaderFn func(io.Reader) error
 
 func (b *bucket) GetAndRename(key string, nBkt Bucket, nKey string, overwrite bool, fn ReaderFn, mws ...mw.Middleware) (err error) {
-	b.mux.RLock()
-	fi, ok := b.keys[key]
+	defer b.wrapErr("GetAndRename", key, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.db.checkKey(key); err != nil {
+		return
+	}
+	if err = b.db.checkKey(nKey); err != nil {
+		return
+	}
+	if err = b.rlock(); err != nil {
+		return
+	}
+	fi, ok := b.keys.Get(key)
 	b.mux.RUnlock()
 
 	if !ok {
-		return os.ErrNotExist
+		return ErrNotFound
 	}
 
 	var (
 		rd    *Reader
 		fname = fi.Name()
-		path  = filepath.Join(b.path, fname)
+		path  = b.filePath(fname)
 		rc    io.ReadCloser
 		nb    *bucket
 	)
@@ -319,12 +593,22 @@ func (b *bucket) GetAndRename(key string, nBkt Bucket, nKey string, overwrite bo
 
 	var (
 		nf    *file
-		nPath = filepath.Join(nb.path, nKey)
+		nPath string
 	)
+	if nPath, err = nb.prepareFile(b.db.keyFileName(nKey)); err != nil {
+		return
+	}
 
-	defer nb.db.lk.Lock(nPath).Unlock()
+	defer func() { // registered first so it runs after all the locks are released
+		if err == nil {
+			err = b.db.fsyncDirs(filepath.Dir(path), b.path, filepath.Dir(nPath), nb.path)
+		}
+	}()
 
-	defer b.db.lk.Lock(path).Unlock()
+	if nPath == path {
+		return ErrSamePath
+	}
+	defer b.db.lk.LockPair(path, nPath)()
 
 	if rd, err = b.files.Get(path); err != nil {
 		return
@@ -334,7 +618,10 @@ func (b *bucket) GetAndRename(key string, nBkt Bucket, nKey string, overwrite bo
 		return
 	}
 
-	nb.mux.Lock()
+	if err = nb.lock(); err != nil {
+		rc.Close()
+		return
+	}
 	nb.files.mux.Lock()
 
 	if nf, ok = nb.files.m[nKey]; !ok {
@@ -364,53 +651,106 @@ func (b *bucket) GetAndRename(key string, nBkt Bucket, nKey string, overwrite bo
 	}
 	rc.Close()
 
-	b.mux.Lock()
-	defer b.mux.Unlock()
-
-	if b != nb { // make sure it's not the same bucket or we will get a deadlock
-		nb.mux.Lock()
-		defer nb.mux.Unlock()
+	if err = b.lockWritePair(nb); err != nil {
+		return
 	}
+	defer b.unlockWritePair(nb)
 
-	if err = os.Rename(path, nPath); err != nil {
+	if err = b.db.fs.Rename(path, nPath); err != nil {
 		return
 	}
 
 	var st os.FileInfo
-	if st, err = os.Stat(nPath); err != nil {
+	if st, err = b.db.fs.Stat(nPath); err != nil {
 		return
 	}
 
-	delete(b.keys, key)
+	b.removeKey(key)
 	b.files.Delete(path)
-	nb.keys[nKey] = st
+	nb.setKey(nKey, st)
+	b.moveExpiry(key, nb, nKey)
+	b.meta.SetChanged(key) // renames keep the modification time
+	nb.meta.SetChanged(nKey)
 	if !ok {
 		nb.meta.incCounter()
 	}
-	return
+	return b.storeMetaPair(nb)
 }
 
 func (b *bucket) Delete(key string) (err error) {
-	b.mux.Lock()
-	if fi, ok := b.keys[key]; ok {
-		path := filepath.Join(b.path, fi.Name())
-		defer b.db.lk.Lock(path).Unlock()
-		err = os.Remove(path)
-		delete(b.keys, key)
+	defer b.wrapErr("Delete", key, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.db.checkKey(key); err != nil {
+		return
+	}
+	var (
+		deleted bool
+		path    string
+	)
+	defer func() { // registered first so it runs after the path lock is released
+		if err == nil && deleted {
+			err = b.db.fsyncDirs(filepath.Dir(path), b.path)
+		}
+	}()
+	if err = b.rlock(); err != nil {
+		return
+	}
+	fi, ok := b.keys.Get(key)
+	b.mux.RUnlock()
+	if !ok {
+		return
+	}
+	path = b.filePath(fi.Name())
+	defer b.db.lk.Lock(path).Unlock() // the path lock is always taken before the bucket lock
+
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	if _, ok = b.keys.Get(key); ok {
+		err = b.db.fs.Remove(path)
+		b.nukeKey(key)
 		b.files.Delete(path)
+		if err == nil { // so the tombstone in Changed survives a crash
+			err = b.meta.store()
+		}
+		deleted = true
 	}
-	b.mux.Unlock()
+	b.unlockWrite()
 	return
 }
 
 func (b *bucket) Rename(key string, nBkt Bucket, nKey string) (err error) {
-	b.mux.Lock()
-	defer b.mux.Unlock()
-	fi, ok := b.keys[key]
+	defer b.wrapErr("Rename", key, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.db.checkKey(key); err != nil {
+		return
+	}
+	if err = b.db.checkKey(nKey); err != nil {
+		return
+	}
+	var (
+		nb          *bucket
+		path, npath string
+	)
+	defer func() { // registered first so it runs after all the locks are released
+		if err == nil {
+			err = b.db.fsyncDirs(filepath.Dir(path), b.path, filepath.Dir(npath), nb.path)
+		}
+	}()
+	if err = b.rlock(); err != nil {
+		return
+	}
+	fi, ok := b.keys.Get(key)
+	b.mux.RUnlock()
 	if !ok {
-		return os.ErrNotExist
+		return ErrNotFound
 	}
-	var nb *bucket
 	switch v := nBkt.(type) {
 	case *bucket:
 		nb = v
@@ -420,78 +760,71 @@ func (b *bucket) Rename(key string, nBkt Bucket, nKey string) (err error) {
 		return ErrInvalidBucketType
 	}
 
-	path := filepath.Join(b.path, fi.Name())
-	npath := filepath.Join(nb.path, filepath.Clean(nKey))
+	path = b.filePath(fi.Name())
+	if npath, err = nb.prepareFile(b.db.keyFileName(nKey)); err != nil {
+		return
+	}
 	if npath == path {
 		return ErrSamePath
 	}
 
-	defer b.db.lk.Lock(path).Unlock()
-	defer nb.db.lk.Lock(npath).Unlock()
+	// the path locks are always taken before the bucket locks
+	defer b.db.lk.LockPair(path, npath)()
+
+	if err = b.lockWritePair(nb); err != nil {
+		return
+	}
+	defer b.unlockWritePair(nb)
+	if _, ok = b.keys.Get(key); !ok { // deleted while we waited for the locks
+		return ErrNotFound
+	}
 
-	if err = os.Rename(path, npath); err != nil {
+	if err = b.db.fs.Rename(path, npath); err != nil {
 		return
 	}
 
-	delete(b.keys, key)
+	b.removeKey(key)
 	b.files.Delete(path)
 
 	var st os.FileInfo
-	if st, err = os.Stat(npath); err != nil {
+	if st, err = b.db.fs.Stat(npath); err != nil {
 		return
 	}
 
-	if nb != b {
-		nb.mux.Lock()
-		defer nb.mux.Unlock()
-	}
-
-	nb.keys[nKey] = st
-
-	return
-}
-
-func (b *bucket) deleteTimed(key string, ct time.Time) {
-	now := time.Now().Unix()
-
-	b.mux.Lock()
-	defer b.mux.Unlock()
-	if fi, ok := b.keys[key]; ok {
-		var exp int64
-		if exp, ok = b.meta.ExpiryDate[key]; !ok {
-			return
-		}
-
-		if exp == 0 || now < exp {
-			return
-		}
+	nb.setKey(nKey, st)
+	b.moveExpiry(key, nb, nKey)
+	b.meta.SetChanged(key) // renames keep the modification time
+	nb.meta.SetChanged(nKey)
 
-		if !fi.ModTime().Equal(ct) { // if the file was modified, don't delete it
-			return
-		}
-
-		path := filepath.Join(b.path, fi.Name())
-		os.Remove(path)
-		b.nukeKey(key)
-		b.files.Delete(path)
-	}
+	return b.storeMetaPair(nb)
 }
 
+// nukeKey must be called with b.mux held.
 func (b *bucket) nukeKey(key string) {
-	delete(b.keys, key)
+	b.meta.dirty = true // callers that don't store it leave it to flushMetaLocked
+	b.removeKey(key)
+	b.meta.SetChanged(key)
 	delete(b.meta.ExpiryDate, key)
+	delete(b.meta.Sliding, key)
 	delete(b.meta.Extra, key)
+	b.db.expiry.Cancel(b, key)
 }
 
 func (b *bucket) Buckets(rev bool) (out []string) {
-	b.mux.RLock()
+	if err := b.rlock(); err != nil {
+		b.logErr("Buckets", err)
+		return
+	}
 	out = b.buckets.Sort(rev)
 	b.mux.RUnlock()
 	return
 }
 
 func (b *bucket) Keys(reverse bool) (out []string) {
-	b.mux.RLock()
+	if err := b.rlock(); err != nil {
+		b.logErr("Keys", err)
+		return
+	}
 	out = b.keys.Names(reverse)
 	b.mux.RUnlock()
 	return
@@ -499,7 +832,10 @@ func (b *bucket) Keys(reverse bool) (out []string) {
 
 func (b *bucket) AllExtraData() (out map[string]map[string]string) {
 	out = make(map[string]map[string]string)
-	b.mux.RLock()
+	if err := b.rlock(); err != nil {
+		b.logErr("AllExtraData", err)
+		return
+	}
 	for _, p := range b.keys.Names(false) {
 		out[p] = b.meta.CopyExtra(p)
 	}
@@ -507,28 +843,51 @@ func (b *bucket) AllExtraData() (out map[string]map[string]string) {
 	return
 }
 
+// reload lists the keys and child buckets of the bucket, it must be called with b.mux held.
 func (b *bucket) reload() error {
-	files, dirs, err := lsDir(b.path)
+	files, paths, dirs, err := b.listFiles()
 	if err != nil {
 		log.Println(err)
 		return err
 	}
 
-	b.keys = make(keyList, len(files)) // it could be overallocated if we have child buckets / metadata but that's ok
-	b.buckets = make(buckets, len(dirs))
-	now := time.Now().Unix()
-	for _, fi := range files {
+	keys := make(map[string]os.FileInfo, len(files))
+	moved := false
+	for i, fi := range files {
 		fn := fi.Name()
-		key, err := b.db.decodeKey(fn)
+		key, err := b.fileKey(fn)
 		if err != nil {
+			if isLongKeyFile(fn) {
+				b.quarantineLongKeyFile(paths[i])
+			}
 			continue
 		}
-		if ts, ok := b.meta.ExpiryDate[key]; ok {
-			if ts != 0 && ts <= now {
-				os.Remove(filepath.Join(b.path, fn))
+		path := b.filePath(fn)
+		if paths[i] != path {
+			if err = b.moveFile(paths[i], path); err != nil {
+				return err
 			}
+			moved = true
+		}
+		if ts := b.meta.ExpiryDate[key]; ts != 0 {
+			// keys that already expired go through the scheduler as well so the expiry policy applies to them,
+			// they get expired as soon as it runs
+			b.db.expiry.Schedule(time.Unix(ts, 0), b, key)
+		}
+		keys[key] = fi
+	}
+	b.keys = loadKeyList(keys)
+
+	if b.pruneLongKeys() {
+		if err = b.meta.store(); err != nil {
+			return err
+		}
+	}
+
+	if moved && b.layout == LayoutFlat { // migrated back from sharded
+		if err = b.db.fs.RemoveAll(filepath.Join(b.path, shardsDirName)); err != nil {
+			return err
 		}
-		b.keys[key] = fi
 	}
 
 	for _, fi := range dirs {
@@ -536,9 +895,19 @@ func (b *bucket) reload() error {
 		if err != nil {
 			continue
 		}
-		if _, err = b.CreateBucket(key); err != nil {
+		if _, ok := b.buckets[key]; ok { // reloading after being unloaded
+			continue
+		}
+		if b.db.opts.LazyLoad {
+			b.buckets[key] = openBucket(b, key, filepath.Join(b.path, fi.Name()), b.db)
+			continue
+		}
+		cb, err := newBucket(b, key, b.path, b.db)
+		if err != nil {
 			log.Printf("wtfmate %v", err)
+			continue
 		}
+		b.buckets[key] = cb
 	}
 
 	return nil
@@ -547,21 +916,46 @@ func (b *bucket) reload() error {
 // ForEach loops over all the keys in the bucket in order and calls fn with a reader.
 // *note* this function read-locks the bucket.
 func (b *bucket) ForEach(fn func(key string, value io.Reader) error, middlewares ...mw.Middleware) error {
-	return b.forEach(false, fn, middlewares...)
+	return b.ForEachContext(context.Background(), fn, middlewares...)
+}
+
+// ForEachContext is ForEach, but it stops once ctx is done and returns ctx.Err(),
+// reading a value after that fails with ctx.Err() too.
+func (b *bucket) ForEachContext(ctx context.Context, fn func(key string, value io.Reader) error, middlewares ...mw.Middleware) (err error) {
+	defer b.wrapErr("ForEach", "", &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	return b.forEach(ctx, false, fn, middlewares...)
 }
 
 // ForEachReverse loops over all the keys in the bucket in order and calls fn with a reader.
 // *note* this function read-locks the bucket.
-func (b *bucket) ForEachReverse(fn func(key string, value io.Reader) error, middlewares ...mw.Middleware) error {
-	return b.forEach(true, fn, middlewares...)
+func (b *bucket) ForEachReverse(fn func(key string, value io.Reader) error, middlewares ...mw.Middleware) (err error) {
+	defer b.wrapErr("ForEachReverse", "", &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	return b.forEach(context.Background(), true, fn, middlewares...)
 }
 
-func (b *bucket) forEach(rev bool, fn func(key string, value io.Reader) error, middlewares ...mw.Middleware) error {
-	b.mux.RLock()
+func (b *bucket) forEach(ctx context.Context, rev bool, fn func(key string, value io.Reader) error, middlewares ...mw.Middleware) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := b.rlockContext(ctx); err != nil {
+		return err
+	}
 	defer b.mux.RUnlock()
 
 	for _, k := range b.keys.Names(rev) {
-		path := filepath.Join(b.path, b.keys[k].Name())
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fi, _ := b.keys.Get(k)
+		path := b.filePath(fi.Name())
 		rd, err := b.files.Get(path)
 		if err != nil { // should we return this error? it means the file could have been moved / deleted
 			continue
@@ -572,7 +966,7 @@ func (b *bucket) forEach(rev bool, fn func(key string, value io.Reader) error, m
 		}
 		func() {
 			defer recover()
-			err = fn(k, rc)
+			err = fn(k, withContext(ctx, rc))
 		}()
 		rc.Close()
 		if err != nil {
@@ -584,7 +978,12 @@ func (b *bucket) forEach(rev bool, fn func(key string, value io.Reader) error, m
 
 func (b *bucket) NextID() *big.Int {
 	n := big.NewInt(0)
+	if err := b.rlock(); err != nil {
+		b.logErr("NextID", err)
+		return n
+	}
 	n.SetString(b.meta.Counter.String(), 10)
+	b.mux.RUnlock()
 	return n
 }
 
@@ -592,15 +991,33 @@ func (b *bucket) Group(mws ...mw.Middleware) Bucket {
 	return &group{b, mws}
 }
 
+// Import imports a tar archive made by Export, restoring the expiry and extra data of the keys
+// and the counter, default TTL, expiry and archive bucket of every bucket in it.
+// the tombstones of incremental archives delete their key or bucket, see ExportWithOptions.
 func (b *bucket) Import(r io.Reader) error {
+	return b.ImportContext(context.Background(), r)
+}
+
+// ImportContext is Import, but it stops once ctx is done and returns ctx.Err(),
+// the keys imported until then are kept and the one being imported is left untouched.
+func (b *bucket) ImportContext(ctx context.Context, r io.Reader) (err error) {
+	defer b.wrapErr("Import", "", &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
 	var tr *tar.Reader
 	if rd, ok := r.(*tar.Reader); ok {
 		tr = rd
 	} else {
-		tr = tar.NewReader(r)
+		tr = tar.NewReader(withContext(ctx, r))
 	}
 
+	var imported []importedBucket
 	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			break
@@ -608,100 +1025,136 @@ func (b *bucket) Import(r io.Reader) error {
 		if err != nil {
 			return err
 		}
-		if hdr.Typeflag != tar.TypeReg {
+
+		if hdr.Typeflag != tar.TypeDir && hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if _, ok := hdr.PAXRecords[paxManifest]; ok {
+			continue
+		}
+		names, err := entryNames(hdr)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := hdr.PAXRecords[paxDeleted]; ok {
+			if err = b.importTombstone(names, hdr.Typeflag == tar.TypeDir); err != nil {
+				return err
+			}
 			continue
 		}
-		path, name := filepath.Split(hdr.Name)
-		path = strings.TrimSuffix(path, string(filepath.Separator))
-		if path == "" {
-			if err = b.Put(name, tr); err != nil {
+
+		if hdr.Typeflag == tar.TypeDir {
+			bb, err := b.importPath(names)
+			if err != nil {
 				return err
 			}
+			ib, err := bb.importBucket(hdr.PAXRecords)
+			if err != nil {
+				return err
+			}
+			imported = append(imported, ib)
 			continue
 		}
 
-		bb, err := b.CreateBucket(strings.Split(path, string(filepath.Separator))...)
+		if len(names) == 0 {
+			continue
+		}
+		bb, err := b.importPath(names[:len(names)-1])
 		if err != nil {
 			return err
 		}
-		if err = bb.Put(name, tr); err != nil {
+		if err = bb.importKey(ctx, names[len(names)-1], tr, hdr.PAXRecords); err != nil {
 			return err
 		}
 	}
+
+	for _, ib := range imported {
+		if err = ib.restore(); err != nil {
+			return
+		}
+	}
 	return nil
 }
 
-func (b *bucket) Export(w io.Writer, exclude ...string) (err error) {
-	var (
-		tw          *tar.Writer
-		el          oerrs.ErrorList
-		rootPathLen = len(b.db.root.path) + 1 // strip the physical part of the path
-
-	)
+// Export writes the bucket and its children to w as a tar archive, the metadata Import restores
+// is stored in PAX records, and every bucket has a directory entry so empty ones aren't lost.
+// entries are named after the bucket names and keys, not how they're stored, so Import can use any key encoding.
+// exclude are paths of buckets and keys to skip, their names joined by / starting from the root bucket.
+// every bucket is captured as it is at the time, writers only wait for the capture, not for the archive to be written.
+func (b *bucket) Export(w io.Writer, exclude ...string) error {
+	return b.ExportContext(context.Background(), w, exclude...)
+}
 
-	if len(b.path) > rootPathLen && genh.Contains(exclude, b.path[rootPathLen:]) {
-		return nil
+// ExportContext is Export, but it stops once ctx is done and returns ctx.Err(), leaving w with a partial archive.
+func (b *bucket) ExportContext(ctx context.Context, w io.Writer, exclude ...string) (err error) {
+	defer b.wrapErr("Export", "", &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
 	}
+	defer b.db.ops.end()
+	return b.export(ctx, w, &exportScope{exclude: exclude})
+}
 
-	if otw, ok := w.(*tar.Writer); ok {
-		tw = otw
-	} else {
-		tw = tar.NewWriter(w)
-		defer func() { el.PushIf(tw.Close()); err = el.Err() }()
+// ExportWithOptions is ExportContext, but it can only export what changed since a previous export, see ExportOptions.
+// the archive ends with the returned manifest, Import skips it and ReadManifest returns it.
+// incremental archives have tombstones for the keys and buckets deleted since, Import deletes them,
+// so they can be imported in order on top of a restored full export.
+func (b *bucket) ExportWithOptions(ctx context.Context, w io.Writer, opts ExportOptions) (_ *Manifest, err error) {
+	defer b.wrapErr("Export", "", &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
 	}
-
-	b.mux.Lock()
-	defer b.mux.Unlock()
-
-	for _, n := range b.keys.Names(false) {
-		var (
-			fi      = b.keys[n]
-			path    = filepath.Join(b.path, fi.Name())
-			tarPath = path[rootPathLen:]
-			hdr     *tar.Header
-			rd      *Reader
-		)
-
-		if genh.Contains(exclude, tarPath) {
-			continue
-		}
-
-		if hdr, err = tar.FileInfoHeader(fi, ""); err != nil {
-			el.PushIf(err)
-			return
-		}
-		hdr.Name = tarPath
-
-		if err = tw.WriteHeader(hdr); err != nil {
-			el.PushIf(err)
-			return
-		}
-		if rd, err = b.files.Get(path); err != nil {
-			log.Printf("err [%s, %s]: %v", n, tarPath, err)
-			continue
-		}
-		_, err = io.Copy(tw, rd)
-		rd.Close()
-		if err != nil {
-			return
+	defer b.db.ops.end()
+	sc := &exportScope{exclude: opts.Exclude, base: opts.Base, manifest: &Manifest{Time: time.Now()}}
+	if opts.Base == nil && !opts.Since.IsZero() {
+		if opts.Since.Before(sc.manifest.Time.Add(-b.db.opts.ChangeRetention)) {
+			return nil, ErrSinceTooOld
 		}
+		sc.since = opts.Since.UnixNano()
 	}
+	if err = b.export(ctx, w, sc); err != nil {
+		return
+	}
+	return sc.manifest, nil
+}
 
-	for _, cb := range b.buckets {
-		if err = cb.Export(tw, exclude...); err != nil {
-			el.PushIf(err)
-			return
-		}
+func (b *bucket) export(ctx context.Context, w io.Writer, sc *exportScope) (err error) {
+	// the locks are only held while capturing the entries, writers keep going while they're streamed
+	entries, err := b.capture(ctx, sc)
+	if err != nil || len(entries) == 0 {
+		b.db.releaseEntries(entries)
+		return
 	}
 
+	var el oerrs.ErrorList
+	tw, ok := w.(*tar.Writer)
+	if !ok {
+		tw = tar.NewWriter(w)
+		defer func() { el.PushIf(tw.Close()); err = el.Err() }()
+	}
+	if err = b.db.writeEntries(ctx, tw, entries); err == nil && sc.manifest != nil {
+		err = writeManifest(tw, sc.manifest)
+	}
+	el.PushIf(err)
 	return
 }
 
 func (b *bucket) Stat(key string) (fi os.FileInfo, err error) {
+	defer b.wrapErr("Stat", key, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
 	var ok bool
-	b.mux.RLock()
-	if fi, ok = b.keys[key]; !ok {
-		err = ErrFileDoesNotExist
+	if err = b.db.checkKey(key); err != nil {
+		return
+	}
+	if err = b.rlock(); err != nil {
+		return
+	}
+	if fi, ok = b.keys.Get(key); !ok {
+		err = ErrNotFound
 	}
 	b.mux.RUnlock()
 	return
@@ -709,20 +1162,39 @@ func (b *bucket) Stat(key string) (fi os.FileInfo, err error) {
 
 // SetExtraData sets extra meta data on the specified file.
 // pass nil to val to delete the data associated with the key.
-func (b *bucket) SetExtraData(fileKey, key string, val string) error {
-	b.mux.Lock()
-	defer b.mux.Unlock()
+func (b *bucket) SetExtraData(fileKey, key string, val string) (err error) {
+	defer b.wrapErr("SetExtraData", fileKey, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.db.checkKey(fileKey); err != nil {
+		return
+	}
+	defer func() { // registered first so it runs after the lock is released
+		if err == nil {
+			err = b.db.fsyncDir(b.path)
+		}
+	}()
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	defer b.unlockWrite()
 
-	if _, ok := b.keys[fileKey]; !ok {
-		return os.ErrNotExist
+	if _, ok := b.keys.Get(fileKey); !ok {
+		return ErrNotFound
 	}
 
 	b.meta.SetExtraData(fileKey, key, val)
+	b.meta.SetChanged(fileKey)
 	return b.meta.store()
 }
 
 func (b *bucket) GetExtraData(fileKey, key string) (out string) {
-	b.mux.RLock()
+	if err := b.rlock(); err != nil {
+		b.logErr("GetExtraData", err)
+		return
+	}
 	out = b.meta.Extra[fileKey][key]
 	b.mux.RUnlock()
 
@@ -730,13 +1202,16 @@ func (b *bucket) GetExtraData(fileKey, key string) (out string) {
 }
 
 func (b *bucket) ExtraData(fileKey string) (out map[string]string) {
-	b.mux.RLock()
+	if err := b.rlock(); err != nil {
+		b.logErr("ExtraData", err)
+		return
+	}
 	defer b.mux.RUnlock()
 
 	d := b.meta.Extra[fileKey]
 	out = make(map[string]string, len(d))
 
-	for k, v := range out {
+	for k, v := range d {
 		out[k] = v
 	}
 
@@ -17,6 +17,8 @@ func (wr *MiddlewareError) Error() string {
 	return wr.Mw.Name() + ":  " + wr.Err.Error()
 }
 
+func (wr *MiddlewareError) Unwrap() error { return wr.Err }
+
 type writerChain []io.WriteCloser
 
 func (wc writerChain) Write(p []byte) (int, error) {
@@ -37,6 +39,35 @@ func (rc readerChain) Read(p []byte) (int, error) {
 	return rc[len(rc)-1].Read(p)
 }
 
+// ReadAt implements io.ReaderAt if the last middleware's reader does.
+func (rc readerChain) ReadAt(p []byte, off int64) (int, error) {
+	if ra, ok := rc[len(rc)-1].(io.ReaderAt); ok {
+		return ra.ReadAt(p, off)
+	}
+	return 0, ErrNotSeekable
+}
+
+// Seek implements io.Seeker if the last middleware's reader does.
+func (rc readerChain) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := rc[len(rc)-1].(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, ErrNotSeekable
+}
+
+// asReaderAt returns r as an io.ReaderAt if it really supports it,
+// readerChain and the readers returned by GetContext always implement ReadAt even if the last middleware doesn't.
+func asReaderAt(r io.Reader) (ra io.ReaderAt, ok bool) {
+	if cr, isCtx := r.(*ctxReadCloser); isCtx {
+		r = cr.rc
+	}
+	if rc, isChain := r.(readerChain); isChain {
+		r = rc[len(rc)-1]
+	}
+	ra, ok = r.(io.ReaderAt)
+	return
+}
+
 func (rc readerChain) Close() error {
 	var errl oerrs.ErrorList
 	for i := len(rc) - 1; i >= 0; i-- {
@@ -62,7 +93,20 @@ func (mwl middlewareList) applyWriters(path string, w io.WriteCloser) (io.WriteC
 	return wc, nil
 }
 
+// checkAppend returns ErrNotAppendable if any of the middlewares can't append to a value it wrote.
+func (mwl middlewareList) checkAppend() error {
+	for _, m := range mwl {
+		if a, ok := m.(mw.Appender); ok && !a.CanAppend() {
+			return &MiddlewareError{m, ErrNotAppendable}
+		}
+	}
+	return nil
+}
+
 func (mwl middlewareList) applyReaders(path string, rd *Reader) (io.ReadCloser, error) {
+	if len(mwl) == 0 { // so callers can type assert *Reader for ReadAt / Seek
+		return rd, nil
+	}
 	var (
 		r  io.ReadCloser = rd
 		rc               = append(make(readerChain, 0, len(mwl)+1), rd)
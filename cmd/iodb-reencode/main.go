@@ -0,0 +1,42 @@
+// iodb-reencode switches an existing database to another key encoding, the database must not be in use.
+// if it gets interrupted, running it again finishes the job.
+//
+//	iodb-reencode -from base64 -to percent /path/to/db
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/alpineiq/iodb"
+)
+
+var encoders = map[string]iodb.KeyEncoder{
+	"plain":   iodb.PlainKeys,
+	"base64":  iodb.Base64Keys,
+	"percent": iodb.PercentKeys,
+	"base32":  iodb.Base32Keys,
+	"hex":     iodb.HexKeys,
+}
+
+func main() {
+	from := flag.String("from", "base64", "current key encoding (plain, base64, percent, base32 or hex)")
+	to := flag.String("to", "", "new key encoding")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] path\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	fromEnc, toEnc := encoders[*from], encoders[*to]
+	if flag.NArg() != 1 || fromEnc == nil || toEnc == nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := iodb.Reencode(flag.Arg(0), fromEnc, toEnc, nil); err != nil {
+		log.Fatal(err)
+	}
+}
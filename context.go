@@ -0,0 +1,61 @@
+package iodb
+
+import (
+	"context"
+	"io"
+)
+
+// withContext returns r wrapped so reads fail with ctx.Err() once ctx is done, r itself if ctx can't be cancelled.
+func withContext(ctx context.Context, r io.Reader) io.Reader {
+	if ctx.Done() == nil {
+		return r
+	}
+	return &ctxReader{ctx, r}
+}
+
+type ctxReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+// readCloserWithContext is withContext for the readers returned by GetContext,
+// it keeps supporting io.ReaderAt and io.Seeker if rc does.
+func readCloserWithContext(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	if ctx.Done() == nil {
+		return rc
+	}
+	return &ctxReadCloser{ctxReader{ctx, rc}, rc}
+}
+
+type ctxReadCloser struct {
+	ctxReader
+	rc io.ReadCloser
+}
+
+func (r *ctxReadCloser) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if ra, ok := asReaderAt(r.rc); ok {
+		return ra.ReadAt(p, off)
+	}
+	return 0, ErrNotSeekable
+}
+
+func (r *ctxReadCloser) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := r.rc.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, ErrNotSeekable
+}
+
+func (r *ctxReadCloser) Close() error {
+	return r.rc.Close()
+}
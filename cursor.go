@@ -0,0 +1,213 @@
+package iodb
+
+import (
+	"io"
+	"strings"
+
+	"github.com/alpineiq/iodb/mw"
+)
+
+// CursorOptions limits the keys a Cursor visits, the zero value visits every key.
+type CursorOptions struct {
+	// Prefix limits the cursor to keys starting with it.
+	Prefix string
+	// Start is the first key of the range (inclusive).
+	Start string
+	// End is the end of the range (exclusive), empty means no end.
+	End string
+	// Limit stops the cursor after returning Limit keys since it was last positioned with First, Last or Seek,
+	// <= 0 means no limit.
+	Limit int
+}
+
+// Cursor iterates over the keys of a bucket in order.
+// it doesn't hold any locks between calls, keys added or removed while iterating are picked up or skipped
+// depending on which side of the cursor they are.
+type Cursor struct {
+	b    *bucket
+	src  Bucket // used for Value, so groups can apply their middleware
+	opts CursorOptions
+
+	key     string
+	valid   bool
+	started bool
+	n       int
+}
+
+// Cursor returns a new cursor over the keys of the bucket, opts can be nil.
+func (b *bucket) Cursor(opts *CursorOptions) *Cursor {
+	return newCursor(b, b, opts)
+}
+
+func newCursor(b *bucket, src Bucket, opts *CursorOptions) *Cursor {
+	c := &Cursor{b: b, src: src}
+	if opts != nil {
+		c.opts = *opts
+	}
+	return c
+}
+
+// First moves the cursor to the first key.
+func (c *Cursor) First() (key string, ok bool) {
+	c.reset()
+	return c.move(c.first())
+}
+
+// Last moves the cursor to the last key.
+func (c *Cursor) Last() (key string, ok bool) {
+	c.reset()
+	return c.move(c.last())
+}
+
+// Seek moves the cursor to the first key >= key.
+func (c *Cursor) Seek(key string) (_ string, ok bool) {
+	c.reset()
+	return c.move(c.after(key, true))
+}
+
+// Next moves the cursor to the next key, if the cursor wasn't positioned yet, it's the same as First.
+func (c *Cursor) Next() (key string, ok bool) {
+	if !c.started {
+		return c.First()
+	}
+	if !c.valid {
+		return "", false
+	}
+	return c.move(c.after(c.key, false))
+}
+
+// Prev moves the cursor to the previous key, if the cursor wasn't positioned yet, it's the same as Last.
+func (c *Cursor) Prev() (key string, ok bool) {
+	if !c.started {
+		return c.Last()
+	}
+	if !c.valid {
+		return "", false
+	}
+	return c.move(c.before(c.key))
+}
+
+// Key returns the current key.
+func (c *Cursor) Key() (key string, ok bool) {
+	return c.key, c.valid
+}
+
+// Value returns the value of the current key.
+func (c *Cursor) Value(middlewares ...mw.Middleware) (io.ReadCloser, error) {
+	if !c.valid {
+		return nil, ErrNotFound
+	}
+	return c.src.Get(c.key, middlewares...)
+}
+
+// Page returns up to n keys starting at the cursor's next key, n <= 0 returns all the remaining keys.
+// Limit still applies.
+func (c *Cursor) Page(n int) (out []string) {
+	for n <= 0 || len(out) < n {
+		key, ok := c.Next()
+		if !ok {
+			break
+		}
+		out = append(out, key)
+	}
+	return
+}
+
+func (c *Cursor) reset() {
+	c.started, c.n = true, 0
+}
+
+func (c *Cursor) move(key string, ok bool) (string, bool) {
+	if ok && c.opts.Limit > 0 && c.n >= c.opts.Limit {
+		ok = false
+	}
+	if !ok {
+		c.valid = false
+		return "", false
+	}
+	c.key, c.valid = key, true
+	c.n++
+	return key, true
+}
+
+func (c *Cursor) lower() string {
+	if c.opts.Prefix > c.opts.Start {
+		return c.opts.Prefix
+	}
+	return c.opts.Start
+}
+
+func (c *Cursor) inRange(key string) bool {
+	return key >= c.opts.Start && (c.opts.End == "" || key < c.opts.End) && strings.HasPrefix(key, c.opts.Prefix)
+}
+
+func (c *Cursor) first() (string, bool) {
+	return c.after(c.lower(), true)
+}
+
+func (c *Cursor) last() (string, bool) {
+	if err := c.b.rlock(); err != nil {
+		c.b.logErr("Cursor", err)
+		return "", false
+	}
+	defer c.b.mux.RUnlock()
+	end := c.opts.End
+	if p := c.opts.Prefix; p != "" {
+		if pe := prefixEnd(p); pe != "" && (end == "" || pe < end) {
+			end = pe
+		}
+	}
+	x := c.b.keys.order.last()
+	if end != "" {
+		x = c.b.keys.order.below(end)
+	}
+	if x != nil && c.inRange(x.key) {
+		return x.key, true
+	}
+	return "", false
+}
+
+// after returns the first key > key, or >= key if inclusive is set.
+func (c *Cursor) after(key string, inclusive bool) (string, bool) {
+	if lo := c.lower(); key < lo {
+		key, inclusive = lo, true
+	}
+	if err := c.b.rlock(); err != nil {
+		c.b.logErr("Cursor", err)
+		return "", false
+	}
+	defer c.b.mux.RUnlock()
+	x := c.b.keys.order.ceil(key)
+	if !inclusive && x != nil && x.key == key {
+		x = x.next[0]
+	}
+	if x != nil && c.inRange(x.key) {
+		return x.key, true
+	}
+	return "", false
+}
+
+// before returns the last key < key.
+func (c *Cursor) before(key string) (string, bool) {
+	if err := c.b.rlock(); err != nil {
+		c.b.logErr("Cursor", err)
+		return "", false
+	}
+	defer c.b.mux.RUnlock()
+	if x := c.b.keys.order.below(key); x != nil && c.inRange(x.key) {
+		return x.key, true
+	}
+	return "", false
+}
+
+// prefixEnd returns the first string greater than every string starting with p, or "" if there's none.
+func prefixEnd(p string) string {
+	b := []byte(p)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
@@ -1,48 +1,168 @@
 package iodb
 
 import (
+	"bufio"
+	"context"
 	"io"
-	"log"
 	"math/big"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alpineiq/iodb/mw"
+	"github.com/alpineiq/iodb/mw/compressors"
 	"go.oneofone.dev/oerrs"
 )
 
-// ErrFileDoesNotExist is returned when a file does not exist
+// ErrFileDoesNotExist is returned when a file does not exist,
+// errors.Is(err, ErrFileDoesNotExist) is true for ErrNotFound.
+//
+// Deprecated: use errors.Is(err, ErrNotFound).
 const ErrFileDoesNotExist = oerrs.String("file does not exist")
 
 // Options allows a bit of customization for iodb.
 type Options struct {
-	Middleware     []mw.Middleware
+	// FS is the filesystem the database is stored on, defaults to OSFS().
+	FS FS
+
+	Middleware []mw.Middleware
+	// PlainFileNames is the same as setting KeyEncoder to PlainKeys.
 	PlainFileNames bool
+	// KeyEncoder maps keys and bucket names to file names, defaults to Base64Keys.
+	// a database must always be opened with the same encoder, see Reencode to switch to another one.
+	KeyEncoder KeyEncoder
+	// KeyValidator is called with the keys passed to every Bucket method, it can enforce app-specific rules,
+	// the errors it returns are wrapped in a *KeyError.
+	KeyValidator func(key string) error
+
+	// SyncMode controls when files and directories are fsynced, defaults to SyncNone.
+	SyncMode SyncMode
+	// SyncBatchWindow is how long SyncBatch waits for other writers to share an fsync with, defaults to 2ms.
+	SyncBatchWindow time.Duration
+
+	// QuarantineTempFiles moves temp files left behind by a crash to the quarantine directory instead of deleting them.
+	QuarantineTempFiles bool
+
+	// LazyLoad opens buckets and loads their keys on first access instead of walking the whole tree in New.
+	// buckets with something to expire get loaded in the background once it's due, going by an index in the root
+	// of the database, the whole tree is walked instead the first time if there's no index yet.
+	// until it gets to them, keys that expired while the db was closed stay around.
+	LazyLoad bool
+	// MaxResidentBuckets caps how many buckets keep their keys and metadata in memory,
+	// the least recently used ones are unloaded and get reloaded on their next access, <= 0 means no limit.
+	MaxResidentBuckets int
+
+	// Layout is the on-disk layout of new buckets, existing buckets keep the one they were created with.
+	Layout Layout
+	// MigrateLayout converts existing buckets to Layout in place as they're loaded.
+	MigrateLayout bool
+
+	// ChangeRetention is how long deleted and renamed keys, deleted buckets and metadata changes are remembered
+	// for ExportOptions.Since, the modification time of the files covers everything else.
+	// exports since further back fail with ErrSinceTooOld, 0 doesn't remember anything.
+	ChangeRetention time.Duration
 }
 
 var defOpts = Options{}
 
 type DB struct {
-	root *bucket
-	opts *Options
-	lk   *pathLocker
+	root     *bucket
+	opts     *Options
+	fs       FS
+	snaps    *snapshotFS
+	lk       *pathLocker
+	recovery *RecoveryReport
+	syncer   *dirSyncer
+	expiry   *expiryScheduler
+	expiries *expiryIndex
+	resident *residentSet
+	ops      *opTracker
+	enc      KeyEncoder
+	rootPath string
+	txMux    sync.Mutex
+	// writes is held for reading by every change to keys and metadata, after any path locks and before the bucket locks,
+	// and for writing, along with txMux, by exports while they capture the database so they see it at a single point in time.
+	writes sync.RWMutex
+
+	closing   chan struct{}
+	closeOnce sync.Once      // closes closing, Close can be called concurrently and more than once
+	bg        sync.WaitGroup // background goroutines, closing stops them
 }
 
+// New opens or creates the database at path, cleaning up after any previous crash,
+// see DB.RecoveryReport for what had to be recovered.
 func New(path string, opts *Options) (*DB, error) {
+	return newDB(path, opts, true)
+}
+
+// newDB is New, expire is false for tools like Reencode that must not expire anything, keys stay scheduled but
+// the scheduler never runs.
+func newDB(path string, opts *Options, expire bool) (*DB, error) {
 	if opts == nil {
 		opts = &defOpts
 	}
 
 	db := &DB{
 		opts: opts,
+		fs:   opts.FS,
 		lk:   newPathLocker(),
+
+		recovery: &RecoveryReport{},
+		expiry:   newExpiryScheduler(),
+		resident: newResidentSet(opts.MaxResidentBuckets),
+		ops:      newOpTracker(),
+		rootPath: filepath.Clean(path),
+		closing:  make(chan struct{}),
+	}
+	if db.fs == nil {
+		db.fs = OSFS()
+	}
+	snaps, err := newSnapshotFS(db.fs, filepath.Join(db.rootPath, snapshotDirName))
+	if err != nil {
+		db.expiry.Stop()
+		db.lk.Close()
+		return nil, err
+	}
+	db.fs, db.snaps = snaps, snaps
+	db.expiries = newExpiryIndex(db)
+	db.expiries.load()
+	if db.enc = opts.KeyEncoder; db.enc == nil {
+		if db.enc = Base64Keys; opts.PlainFileNames {
+			db.enc = PlainKeys
+		}
+	}
+	if opts.SyncMode == SyncBatch {
+		db.syncer = newDirSyncer(db.fs, opts.SyncBatchWindow)
 	}
-	b, err := newBucket("", path, db)
+	b, err := newBucket(nil, "", path, db)
 	if err != nil {
+		db.expiry.Stop()
+		db.lk.Close()
 		return nil, err
 	}
 	db.root = b
+	if err = db.recoverTxns(); err != nil {
+		db.expiry.Stop()
+		db.lk.Close()
+		return nil, err
+	}
+	if !opts.LazyLoad { // every bucket got loaded
+		if err = db.expiries.markComplete(); err != nil {
+			db.expiry.Stop()
+			db.lk.Close()
+			return nil, err
+		}
+	}
+	if expire {
+		db.expiry.RunDue()
+		db.expiry.Start()
+	}
+	if opts.LazyLoad {
+		db.bg.Add(1)
+		go db.warmUp()
+	}
 	return db, nil
 }
 
@@ -55,25 +175,106 @@ func (db *DB) Import(r io.Reader) error {
 	return db.root.Import(r)
 }
 
+// ImportContext is Import, but it stops once ctx is done.
+func (db *DB) ImportContext(ctx context.Context, r io.Reader) error {
+	return db.root.ImportContext(ctx, r)
+}
+
 // Export exports the database to a tar file.
 func (db *DB) Export(w io.Writer, exclude ...string) error {
 	return db.root.Export(w, exclude...)
 }
 
+// ExportContext is Export, but it stops once ctx is done.
+func (db *DB) ExportContext(ctx context.Context, w io.Writer, exclude ...string) error {
+	return db.root.ExportContext(ctx, w, exclude...)
+}
+
+// ExportWithOptions exports the database to a tar file, or only what changed since a previous export, see ExportOptions.
+func (db *DB) ExportWithOptions(ctx context.Context, w io.Writer, opts ExportOptions) (*Manifest, error) {
+	return db.root.ExportWithOptions(ctx, w, opts)
+}
+
 // ExportFile exports the entire database to a tar file.
-// If the file has the gz suffix, it will be automatically compressed.
+// If the file has a suffix compressors.NewCompressorByExt knows, like gz, snappy or flate, it will be compressed with it,
+// any other suffix writes a plain tar.
+// The file is created on the local filesystem, not the database's FS.
 func (db *DB) ExportFile(fn string, exclude ...string) error {
+	comp, err := compressors.NewCompressorByExt(strings.TrimPrefix(filepath.Ext(fn), "."))
+	if err != nil {
+		comp = nil
+	}
+
 	f, err := os.Create(fn)
 	if err != nil {
 		return err
 	}
 
-	var el oerrs.ErrorList
-	el.PushIf(db.Export(f))
+	var (
+		el oerrs.ErrorList
+		w  io.WriteCloser = nopWriteCloser{f}
+	)
+	if comp != nil {
+		if w, err = comp.Writer(fn, f); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	el.PushIf(db.Export(w, exclude...))
+	el.PushIf(w.Close())
 	el.PushIf(f.Close())
 	return el.Err()
 }
 
+// ImportFile imports a file made by ExportFile, the compression is detected from the contents, not the suffix,
+// except for flate, which has no header to detect it by, so those files need a .flate or .deflate suffix,
+// anything else fails with ErrUnknownArchiveFormat.
+// The file is read from the local filesystem, not the database's FS.
+func (db *DB) ImportFile(fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	head, _ := br.Peek(512)
+
+	comp, err := compressors.NewCompressorByMagic(head)
+	if err != nil {
+		switch comp = nil; strings.TrimPrefix(filepath.Ext(fn), ".") {
+		case "flate", "deflate":
+			comp = compressors.NewFlate(6)
+		default:
+			if !isTar(head) {
+				return ErrUnknownArchiveFormat
+			}
+		}
+	}
+
+	var r io.Reader = br
+	if comp != nil {
+		rc, err := comp.Reader(fn, br, nil)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		r = rc
+	}
+	return db.Import(r)
+}
+
+// isTar reports whether head starts with a tar header, every format Go writes has the ustar magic.
+func isTar(head []byte) bool {
+	return len(head) >= 262 && string(head[257:262]) == "ustar"
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
 func (db *DB) CreateBucket(names ...string) (Bucket, error) {
 	return db.root.CreateBucket(names...)
 }
@@ -82,41 +283,74 @@ func (db *DB) Group(mws ...mw.Middleware) Bucket {
 	return &group{db.root, mws}
 }
 
-func (db *DB) Close() error {
+// Close stops accepting new operations, they fail with ErrClosing, and waits for the in-flight ones
+// and for every reader returned by Get to be closed, or for ctx to be done, in which case it returns ctx.Err()
+// without tearing anything down, since they still need it, and can be called again to keep waiting.
+// then it stops expiring keys and stores any metadata changes that weren't stored yet.
+// operations made of other operations, like Import or applying a transaction, can fail halfway with ErrClosing,
+// the journal of a transaction that failed that way is replayed by the next New.
+func (db *DB) Close(ctx context.Context) (err error) {
+	db.closeOnce.Do(func() { close(db.closing) })
+
+	select {
+	case <-db.ops.close():
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	bgDone := make(chan struct{})
+	go func() {
+		db.bg.Wait()
+		close(bgDone)
+	}()
+	select {
+	case <-bgDone:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	db.expiry.Stop()
+	if err = db.flushMeta(); err == nil {
+		err = db.expiries.flush()
+	}
 	db.lk.Close()
-	return nil
+	return
 }
 
 func (db *DB) encodeKey(key string) string {
-	if db.opts.PlainFileNames {
-		checkValidKey(key)
-		return key
-	}
-	return b64EncodeName(key)
+	return db.enc.Encode(key)
 }
 
 func (db *DB) decodeKey(key string) (string, error) {
-	if db.opts.PlainFileNames {
-		checkValidKey(key)
-		return key, nil
+	return db.enc.Decode(key)
+}
+
+// checkKey returns a *KeyError if key can't be stored with the db's KeyEncoder or Options.KeyValidator rejects it.
+func (db *DB) checkKey(key string) error {
+	if err := db.checkName(key); err != nil {
+		return err
 	}
-	return b64DecodeName(key)
+	if db.opts.KeyValidator != nil {
+		if err := db.opts.KeyValidator(key); err != nil {
+			return &KeyError{Key: key, Err: err}
+		}
+	}
+	return nil
 }
 
-// isValidKey checks if the key can be a valid file path
-// mostly based on https://en.wikipedia.org/wiki/Filename#Comparison_of_filename_limitations
-// this function panics because this is a programmer error and the program shouldn't continue.
-func checkValidKey(key string) {
-	const badChars = "\x00\xff/\\:%?*|\"><"
-	if key != "." && key != ".." && strings.ContainsAny(key, badChars) {
-		log.Panicf("%q uses an invalid character (one of %q)", key, badChars)
+// checkName is checkKey for bucket names, they only need to be valid file names.
+func (db *DB) checkName(name string) error {
+	if kc, ok := db.enc.(KeyChecker); ok {
+		return kc.CheckKey(name)
 	}
+	return nil
 }
 
 // Bucket is the interface for Bucket-like containers (buckets and groups)
 type Bucket interface {
 	Append(key string, r io.Reader, middlewares ...mw.Middleware) (err error)
 	AppendFunc(key string, fn func(w io.Writer) error, middlewares ...mw.Middleware) (err error)
+	AppendContext(ctx context.Context, key string, r io.Reader, middlewares ...mw.Middleware) (err error)
 	Bucket(names ...string) Bucket
 	Buckets(rev bool) (out []string)
 	CreateBucket(names ...string) (Bucket, error)
@@ -125,21 +359,42 @@ type Bucket interface {
 	DeleteBucket(name string) (err error)
 	ForEach(fn func(key string, value io.Reader) error, middlewares ...mw.Middleware) error
 	ForEachReverse(fn func(key string, value io.Reader) error, middlewares ...mw.Middleware) error
+	ForEachContext(ctx context.Context, fn func(key string, value io.Reader) error, middlewares ...mw.Middleware) error
 	Get(key string, middlewares ...mw.Middleware) (_ io.ReadCloser, err error)
+	GetContext(ctx context.Context, key string, middlewares ...mw.Middleware) (_ io.ReadCloser, err error)
+	GetRange(key string, off, n int64, middlewares ...mw.Middleware) (_ io.ReadCloser, err error)
 	GetAndDelete(key string, fn func(r io.Reader) error, middlewares ...mw.Middleware) (err error)
 	GetAndRename(key string, nBkt Bucket, nKey string, overwrite bool, fn ReaderFn, mws ...mw.Middleware) (err error)
 	Group(mws ...mw.Middleware) Bucket
 	Keys(reverse bool) (out []string)
+	Cursor(opts *CursorOptions) *Cursor
+	List(opts ListOptions) (*ListPage, error)
 	Name() string
 	NextID() *big.Int
 	Path() string
 	Put(key string, r io.Reader, middlewares ...mw.Middleware) (err error)
+	PutContext(ctx context.Context, key string, r io.Reader, middlewares ...mw.Middleware) (err error)
 	PutFunc(key string, fn func(w io.Writer) error, middlewares ...mw.Middleware) (err error)
 	PutTimed(key string, r io.Reader, expireAfter time.Duration, middlewares ...mw.Middleware) (err error)
 	PutTimedFunc(key string, fn func(w io.Writer) error, expireAfter time.Duration, middlewares ...mw.Middleware) (err error)
 	Import(r io.Reader) (err error)
+	ImportContext(ctx context.Context, r io.Reader) (err error)
 	Export(w io.Writer, exclude ...string) (err error)
+	ExportContext(ctx context.Context, w io.Writer, exclude ...string) (err error)
+	ExportWithOptions(ctx context.Context, w io.Writer, opts ExportOptions) (_ *Manifest, err error)
 	Stat(key string) (fi os.FileInfo, err error)
+	TTL(key string) (time.Duration, error)
+	Expire(key string, d time.Duration) error
+	ExpireAt(key string, t time.Time) error
+	ExpireSliding(key string, d time.Duration) error
+	Persist(key string) error
+	SetExpiryPolicy(p ExpiryPolicy) error
+	ExpiryPolicy() ExpiryPolicy
+	SetDefaultTTL(d time.Duration) error
+	DefaultTTL() time.Duration
+	ExpireBucket(d time.Duration) error
+	ExpireBucketAt(t time.Time) error
+	BucketTTL() time.Duration
 	SetExtraData(fileKey, key string, val string) error
 	GetExtraData(fileKey, key string) (out string)
 	ExtraData(fileKey string) (out map[string]string)
@@ -0,0 +1,178 @@
+package iodb
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// KeyEncoder maps keys and bucket names to file names and back.
+// Encode must return a valid, non-hidden file name for any key it accepts, and Decode must reject any name
+// Encode can't return, that's how the database tells its own files apart from everything else.
+type KeyEncoder interface {
+	Encode(key string) string
+	Decode(name string) (string, error)
+}
+
+// KeyChecker is implemented by key encoders that can't store every key.
+type KeyChecker interface {
+	// CheckKey returns a *KeyError for keys that can't be encoded.
+	CheckKey(key string) error
+}
+
+// KeyError is returned for keys that can't be stored, errors.Is(err, ErrInvalidKey) is true for all of them.
+type KeyError struct {
+	Key  string
+	Char rune  // the offending character, 0 if the key was rejected as a whole
+	Err  error // set when the key was rejected by Options.KeyValidator
+}
+
+func (e *KeyError) Error() string {
+	switch {
+	case e.Err != nil:
+		return fmt.Sprintf("invalid key %q: %v", e.Key, e.Err)
+	case e.Char != 0:
+		return fmt.Sprintf("%q uses an invalid character (%q)", e.Key, e.Char)
+	default:
+		return fmt.Sprintf("%q is not a valid key", e.Key)
+	}
+}
+
+func (e *KeyError) Unwrap() []error {
+	if e.Err != nil {
+		return []error{ErrInvalidKey, e.Err}
+	}
+	return []error{ErrInvalidKey}
+}
+
+var (
+	// PlainKeys stores keys as they are, they can't contain any of `\x00\xff/\:%?*|"><`, start with a dot, or be empty.
+	PlainKeys KeyEncoder = plainKeys{}
+	// Base64Keys encodes keys with unpadded url-safe base64, it's the default.
+	Base64Keys KeyEncoder = base64Keys{}
+	// PercentKeys keeps letters, digits and `-_.~` as they are and percent-encodes everything else,
+	// so names stay readable on disk.
+	PercentKeys KeyEncoder = percentKeys{}
+	// Base32Keys encodes keys with unpadded base32, which is safe on case-insensitive filesystems.
+	Base32Keys KeyEncoder = base32Keys{}
+	// HexKeys encodes keys as lowercase hex.
+	HexKeys KeyEncoder = hexKeys{}
+)
+
+type plainKeys struct{}
+
+// CheckKey is mostly based on https://en.wikipedia.org/wiki/Filename#Comparison_of_filename_limitations
+func (plainKeys) CheckKey(key string) error {
+	const badChars = "\x00\xff/\\:%?*|\"><"
+	if key == "" {
+		return &KeyError{Key: key}
+	}
+	if key[0] == '.' { // hidden files aren't keys, and it takes care of . and .. too
+		return &KeyError{Key: key, Char: '.'}
+	}
+	if i := strings.IndexAny(key, badChars); i != -1 {
+		return &KeyError{Key: key, Char: rune(key[i])}
+	}
+	return nil
+}
+
+// Encode expects a key that passed CheckKey.
+func (plainKeys) Encode(key string) string { return key }
+
+func (pk plainKeys) Decode(name string) (string, error) {
+	if err := pk.CheckKey(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+type base64Keys struct{}
+
+func (base64Keys) Encode(key string) string           { return b64EncodeName(key) }
+func (base64Keys) Decode(name string) (string, error) { return b64DecodeName(name) }
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type base32Keys struct{}
+
+func (base32Keys) Encode(key string) string { return b32.EncodeToString([]byte(key)) }
+
+func (base32Keys) Decode(name string) (string, error) {
+	b, err := b32.DecodeString(name)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type hexKeys struct{}
+
+func (hexKeys) Encode(key string) string { return hex.EncodeToString([]byte(key)) }
+
+func (hexKeys) Decode(name string) (string, error) {
+	if strings.ToLower(name) != name { // hex.DecodeString accepts both cases, but Encode never returns upper case
+		return "", ErrInvalidName
+	}
+	b, err := hex.DecodeString(name)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+type percentKeys struct{}
+
+const upperHex = "0123456789ABCDEF"
+
+func isPercentSafe(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '-' || c == '_' || c == '.' || c == '~'
+}
+
+func (percentKeys) Encode(key string) string {
+	var sb strings.Builder
+	sb.Grow(len(key))
+	for i := 0; i < len(key); i++ {
+		// a leading dot would make it a hidden file, and it takes care of . and .. too
+		if c := key[i]; isPercentSafe(c) && (c != '.' || i > 0) {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteByte('%')
+			sb.WriteByte(upperHex[c>>4])
+			sb.WriteByte(upperHex[c&15])
+		}
+	}
+	return sb.String()
+}
+
+func (percentKeys) Decode(name string) (string, error) {
+	if strings.HasPrefix(name, ".") {
+		return "", ErrInvalidName
+	}
+	var sb strings.Builder
+	sb.Grow(len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c != '%' {
+			if !isPercentSafe(c) {
+				return "", ErrInvalidName
+			}
+			sb.WriteByte(c)
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", ErrInvalidName
+		}
+		hi, lo := strings.IndexByte(upperHex, name[i+1]), strings.IndexByte(upperHex, name[i+2])
+		if hi < 0 || lo < 0 {
+			return "", ErrInvalidName
+		}
+		if c = byte(hi<<4 | lo); isPercentSafe(c) && (c != '.' || i > 0) { // only one name per key
+			return "", ErrInvalidName
+		}
+		sb.WriteByte(c)
+		i += 2
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,79 @@
+package iodb
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned (wrapped in an *Error) for keys and buckets that don't exist,
+// errors.Is(err, os.ErrNotExist) and errors.Is(err, ErrFileDoesNotExist) are true for it as well.
+var ErrNotFound error = notFoundError{}
+
+type notFoundError struct{}
+
+func (notFoundError) Error() string { return "not found" }
+
+func (notFoundError) Is(target error) bool {
+	return target == os.ErrNotExist || target == ErrFileDoesNotExist
+}
+
+// Error is returned by Bucket methods, it says which operation failed on which bucket and key.
+// use errors.Is and errors.As to check what Err is, it can be another iodb error like ErrNotFound or *KeyError,
+// a *MiddlewareError, or an error from the filesystem.
+type Error struct {
+	Op     string // the Bucket method, methods that are shorthands for another one use its name (Put for PutTimedFunc)
+	Bucket string // the names of the bucket and its parents joined by /, empty for the root bucket
+	Key    string // empty for operations on the bucket itself
+	Err    error
+}
+
+func (e *Error) Error() string {
+	var sb strings.Builder
+	sb.WriteString("iodb: ")
+	sb.WriteString(e.Op)
+	if e.Bucket != "" {
+		sb.WriteString(" bucket=")
+		sb.WriteString(strconv.Quote(e.Bucket))
+	}
+	if e.Key != "" {
+		sb.WriteString(" key=")
+		sb.WriteString(strconv.Quote(e.Key))
+	}
+	sb.WriteString(": ")
+	sb.WriteString(e.Err.Error())
+	return sb.String()
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// wrapErr wraps *errp in an *Error, it's deferred first thing by the methods it wraps so it runs last.
+// errors that already are an *Error are left alone, they come from the method that actually failed.
+func (b *bucket) wrapErr(op, key string, errp *error) {
+	err := *errp
+	if err == nil {
+		return
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return
+	}
+	*errp = &Error{Op: op, Bucket: b.fullName(), Key: key, Err: err}
+}
+
+// fullName returns the names of the bucket and its parents joined by /.
+func (b *bucket) fullName() string {
+	return strings.Join(b.names(), "/")
+}
+
+// names returns the names of the bucket and its parents, starting from the child of the root bucket.
+func (b *bucket) names() (names []string) {
+	for ; b != nil && b.parent != nil; b = b.parent {
+		names = append(names, b.name)
+	}
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+	return
+}
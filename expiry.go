@@ -0,0 +1,381 @@
+package iodb
+
+import (
+	"container/heap"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// expiryScheduler deletes expired keys for the whole database from a single goroutine and timer.
+type expiryScheduler struct {
+	h     expiryHeap
+	items map[expiryKey]*expiryItem
+	wake  chan struct{}
+	done  chan struct{}
+	wg    sync.WaitGroup
+	mux   sync.Mutex
+	stop  sync.Once
+}
+
+type expiryKey struct {
+	b      *bucket
+	key    string
+	bucket bool // the bucket itself expires
+	load   bool // the bucket gets loaded, which schedules the expiries of its keys, see expiryIndex
+}
+
+type expiryItem struct {
+	at time.Time
+	expiryKey
+	idx int
+}
+
+// newExpiryScheduler returns a scheduler that queues keys until Start is called.
+func newExpiryScheduler() *expiryScheduler {
+	return &expiryScheduler{
+		items: map[expiryKey]*expiryItem{},
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// Start starts deleting expired keys, New calls it once the whole db is loaded
+// because expiry policies may need to look up other buckets.
+func (es *expiryScheduler) Start() {
+	es.wg.Add(1)
+	go es.run()
+}
+
+// Schedule (re)schedules key to be checked for expiry at the specified time.
+func (es *expiryScheduler) Schedule(at time.Time, b *bucket, key string) {
+	es.schedule(at, expiryKey{b: b, key: key})
+}
+
+// ScheduleBucket (re)schedules b to be checked for expiry at the specified time.
+func (es *expiryScheduler) ScheduleBucket(at time.Time, b *bucket) {
+	es.schedule(at, expiryKey{b: b, bucket: true})
+}
+
+// ScheduleLoad schedules b to be loaded at the specified time, by then it has something to expire.
+func (es *expiryScheduler) ScheduleLoad(at time.Time, b *bucket) {
+	es.schedule(at, expiryKey{b: b, load: true})
+}
+
+func (es *expiryScheduler) schedule(at time.Time, ek expiryKey) {
+	es.mux.Lock()
+	if it := es.items[ek]; it != nil {
+		it.at = at
+		heap.Fix(&es.h, it.idx)
+	} else {
+		it = &expiryItem{at: at, expiryKey: ek}
+		es.items[ek] = it
+		heap.Push(&es.h, it)
+	}
+	first := es.h[0].expiryKey == ek
+	es.mux.Unlock()
+
+	if first {
+		select {
+		case es.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Cancel removes key from the schedule, it's a no-op if it isn't scheduled.
+func (es *expiryScheduler) Cancel(b *bucket, key string) {
+	es.cancel(expiryKey{b: b, key: key})
+}
+
+// CancelBucket removes the expiry of b itself from the schedule.
+func (es *expiryScheduler) CancelBucket(b *bucket) {
+	es.cancel(expiryKey{b: b, bucket: true})
+}
+
+func (es *expiryScheduler) cancel(ek expiryKey) {
+	es.mux.Lock()
+	if it := es.items[ek]; it != nil {
+		heap.Remove(&es.h, it.idx)
+		delete(es.items, ek)
+	}
+	es.mux.Unlock()
+}
+
+// Forget removes everything scheduled for b, used once it has been deleted.
+func (es *expiryScheduler) Forget(b *bucket) {
+	es.mux.Lock()
+	for ek, it := range es.items {
+		if ek.b == b {
+			heap.Remove(&es.h, it.idx)
+			delete(es.items, ek)
+		}
+	}
+	es.mux.Unlock()
+}
+
+// Len returns the number of scheduled keys.
+func (es *expiryScheduler) Len() int {
+	es.mux.Lock()
+	defer es.mux.Unlock()
+	return len(es.h)
+}
+
+// Stop stops the scheduler and waits for it to finish any in-progress deletes.
+func (es *expiryScheduler) Stop() {
+	es.stop.Do(func() { close(es.done) })
+	es.wg.Wait()
+}
+
+// RunDue expires everything that is already due from the calling goroutine, New calls it before Start
+// so keys that expired while the database was closed are gone by the time it returns.
+func (es *expiryScheduler) RunDue() {
+	due, _ := es.popDue(time.Now())
+	es.expire(due)
+}
+
+// popDue removes the items due at now from the schedule, next is how long until the following one or -1.
+func (es *expiryScheduler) popDue(now time.Time) (due []*expiryItem, next time.Duration) {
+	next = -1
+	es.mux.Lock()
+	defer es.mux.Unlock()
+	for len(es.h) > 0 && !es.h[0].at.After(now) {
+		it := heap.Pop(&es.h).(*expiryItem)
+		delete(es.items, it.expiryKey)
+		due = append(due, it)
+	}
+	if len(es.h) > 0 {
+		next = es.h[0].at.Sub(now)
+	}
+	return
+}
+
+// expire deletes the due items, it returns false if the scheduler was stopped in the meantime.
+// the bucket locks are only taken after releasing ours, Schedule is called with them held.
+func (es *expiryScheduler) expire(due []*expiryItem) bool {
+	for _, it := range due {
+		select {
+		case <-es.done:
+			return false
+		default:
+		}
+		switch {
+		case it.bucket:
+			it.b.deleteExpired()
+		case it.load:
+			it.b.warm()
+		default:
+			it.b.deleteTimed(it.key)
+		}
+	}
+	return true
+}
+
+func (es *expiryScheduler) run() {
+	defer es.wg.Done()
+
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+
+	for {
+		due, next := es.popDue(time.Now())
+		if !es.expire(due) {
+			return
+		}
+
+		if !t.Stop() {
+			select {
+			case <-t.C:
+			default:
+			}
+		}
+		if next >= 0 {
+			t.Reset(next)
+		}
+
+		select {
+		case <-t.C:
+		case <-es.wake:
+		case <-es.done:
+			t.Stop()
+			return
+		}
+	}
+}
+
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].idx, h[j].idx = i, j
+}
+
+func (h *expiryHeap) Push(x any) {
+	it := x.(*expiryItem)
+	it.idx = len(*h)
+	*h = append(*h, it)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old) - 1
+	it := old[n]
+	old[n] = nil
+	*h = old[:n]
+	return it
+}
+
+const expiryIndexName = ".expiries"
+
+// expiryIndex records, for every bucket with something that expires, a time at or before its next expiry,
+// so a lazily loaded database only loads the buckets that have something to expire instead of walking the whole tree.
+// an entry can be earlier than it has to be, the bucket just gets loaded before anything is due, but never later,
+// so it's stored before any metadata that moves an expiry earlier. it's only trusted once it covers every bucket.
+type expiryIndex struct {
+	db       *DB
+	root     string
+	next     map[string]int64 // bucket directory relative to the root -> unix seconds
+	complete bool             // it covers every bucket, it isn't stored before that
+	dirty    bool
+	mux      sync.Mutex
+}
+
+func newExpiryIndex(db *DB) *expiryIndex {
+	return &expiryIndex{db: db, root: db.rootPath, next: map[string]int64{}}
+}
+
+// load reads the stored index, without one the whole tree has to be walked before it can be trusted.
+func (ei *expiryIndex) load() {
+	path := filepath.Join(ei.root, expiryIndexName)
+	next := map[string]int64{}
+	if err := readJSONFile(ei.db.fs, path, &next); err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("iodb: ignoring corrupt expiry index (%s): %v", path, err)
+		}
+		return
+	}
+	ei.mux.Lock()
+	ei.next, ei.complete = next, true
+	ei.mux.Unlock()
+}
+
+// lower moves the entry of dir earlier if next is, storing the index right away,
+// it's called before storing metadata whose next expiry is next.
+func (ei *expiryIndex) lower(dir string, next int64) error {
+	rel, err := filepath.Rel(ei.root, dir)
+	if err != nil || next == 0 {
+		return err
+	}
+	ei.mux.Lock()
+	defer ei.mux.Unlock()
+	if cur, ok := ei.next[rel]; ok && cur <= next {
+		return nil
+	}
+	ei.next[rel], ei.dirty = next, true
+	if !ei.complete {
+		return nil
+	}
+	return ei.storeLocked(true)
+}
+
+// set records the next expiry of dir once its metadata is stored, 0 if nothing expires.
+// moving an entry later or removing it can wait for the next time the index gets stored.
+func (ei *expiryIndex) set(dir string, next int64) {
+	rel, err := filepath.Rel(ei.root, dir)
+	if err != nil {
+		return
+	}
+	ei.mux.Lock()
+	defer ei.mux.Unlock()
+	if ei.next[rel] == next {
+		return
+	}
+	if next == 0 {
+		delete(ei.next, rel)
+	} else {
+		ei.next[rel] = next
+	}
+	ei.dirty = true
+}
+
+// forget removes the entry of a deleted bucket.
+func (ei *expiryIndex) forget(dir string) {
+	ei.set(dir, 0)
+}
+
+// entries returns a copy of the index, ok is false if it doesn't cover every bucket yet.
+func (ei *expiryIndex) entries() (next map[string]int64, ok bool) {
+	ei.mux.Lock()
+	defer ei.mux.Unlock()
+	if !ei.complete {
+		return nil, false
+	}
+	next = make(map[string]int64, len(ei.next))
+	for dir, ts := range ei.next {
+		next[dir] = ts
+	}
+	return next, true
+}
+
+// markComplete is called once every bucket has been loaded, which recorded all of them.
+func (ei *expiryIndex) markComplete() error {
+	ei.mux.Lock()
+	defer ei.mux.Unlock()
+	if ei.complete && !ei.dirty {
+		return nil
+	}
+	ei.complete = true
+	return ei.storeLocked(false)
+}
+
+// flush stores the changes that were left for later, Close calls it.
+func (ei *expiryIndex) flush() error {
+	ei.mux.Lock()
+	defer ei.mux.Unlock()
+	if !ei.complete || !ei.dirty {
+		return nil
+	}
+	return ei.storeLocked(false)
+}
+
+// storeLocked only syncs the index, depending on the SyncMode, if sync is set, losing any other change is harmless,
+// an index that got lost or corrupted makes the next New walk the whole tree again.
+func (ei *expiryIndex) storeLocked(sync bool) (err error) {
+	var (
+		fs      = ei.db.fs
+		path    = filepath.Join(ei.root, expiryIndexName)
+		tmpPath = path + ".tmp"
+		b       []byte
+		f       File
+	)
+	if b, err = json.Marshal(ei.next); err != nil {
+		return
+	}
+	if f, err = fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644); err != nil {
+		return
+	}
+	if sync && ei.db.opts.SyncMode >= SyncData {
+		f = syncCloser{f}
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = fs.Rename(tmpPath, path); err != nil {
+		return
+	}
+	ei.dirty = false
+	if sync && ei.db.opts.SyncMode >= SyncFull { // not batched, lower is called with a bucket lock held
+		err = syncDir(fs, ei.root)
+	}
+	return
+}
@@ -0,0 +1,484 @@
+package iodb
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.oneofone.dev/genh"
+)
+
+// PAX records Export stores the metadata of keys and buckets in, buckets are stored as directory entries,
+// "./" for the bucket being exported if it's the root.
+// archives without them, like the ones made before they were added, are imported with the defaults of the target.
+// entry names are the bucket names and key joined by /, they're only used to import entries without a path record.
+const (
+	paxPrefix = "IODB."
+
+	paxPath = paxPrefix + "path" // json, the names of the buckets and key, names can contain /
+
+	paxExpiry  = paxPrefix + "expiry"  // unix seconds, 0 if the key doesn't expire, always set
+	paxSliding = paxPrefix + "sliding" // nanoseconds
+	paxExtra   = paxPrefix + "extra"   // json
+
+	paxCounter      = paxPrefix + "counter"
+	paxDefaultTTL   = paxPrefix + "defaultTTL"   // nanoseconds
+	paxBucketExpiry = paxPrefix + "bucketExpiry" // unix seconds
+	paxArchive      = paxPrefix + "archive"      // json
+
+	paxDeleted  = paxPrefix + "deleted"  // tombstone of the key, or the bucket on directory entries, see ExportOptions
+	paxManifest = paxPrefix + "manifest" // the entry holding the json Manifest of ExportWithOptions
+)
+
+// exportEntry is an archive entry captured by snapshot.
+type exportEntry struct {
+	hdr *tar.Header
+	pin *pin // nil for buckets and tombstones
+}
+
+// exportScope is what snapshot captures, see ExportOptions.
+type exportScope struct {
+	exclude  []string
+	since    int64     // unix nanoseconds, 0 captures everything
+	base     *Manifest // only captures what changed since it if set, takes precedence over since
+	manifest *Manifest // filled with everything in scope if set, changed or not
+}
+
+func (sc *exportScope) excluded(relPath string) bool {
+	return relPath != "" && genh.Contains(sc.exclude, relPath)
+}
+
+// capture snapshots b with transactions and every other change to the database held off,
+// so the entries are of a single point in time even if a change spans several buckets.
+func (b *bucket) capture(ctx context.Context, sc *exportScope) (_ []exportEntry, err error) {
+	db := b.db
+	if err = lockContext(ctx, db.txMux.TryLock, db.txMux.Lock, db.txMux.Unlock); err != nil {
+		return
+	}
+	defer db.txMux.Unlock()
+	if err = lockContext(ctx, db.writes.TryLock, db.writes.Lock, db.writes.Unlock); err != nil {
+		return
+	}
+	defer db.writes.Unlock()
+	return b.snapshot(ctx, nil, sc)
+}
+
+// snapshot appends the entries of b and its children to out, it must be called through capture.
+// the files of the keys are pinned so they can be streamed after the locks are released.
+func (b *bucket) snapshot(ctx context.Context, out []exportEntry, sc *exportScope) (_ []exportEntry, err error) {
+	var (
+		names  = b.names()
+		relDir = strings.Join(names, "/") // the bucket's path inside the archive, independent of the key encoding and layout
+		base   *ManifestBucket
+		m      *ManifestBucket
+	)
+	if sc.excluded(relDir) {
+		return out, nil
+	}
+	if sc.base != nil {
+		if base = sc.base.bucket(names...); base == nil {
+			base = &ManifestBucket{} // new since the base, everything changed
+		}
+	}
+	if sc.manifest != nil {
+		m = sc.manifest.path(names)
+	}
+	if err = b.rlockContext(ctx); err != nil {
+		return out, err
+	}
+	defer b.mux.RUnlock()
+
+	// written even if the bucket is empty so it survives the round trip, and by incremental exports for its metadata
+	out = append(out, exportEntry{hdr: b.bucketHeader(names)})
+	out = b.tombstones(out, names, sc, base)
+
+	for _, n := range b.keys.Names(false) {
+		fi, _ := b.keys.Get(n)
+		tarPath := joinPath(relDir, n)
+		if sc.excluded(tarPath) {
+			continue
+		}
+		recs := b.keyRecords(names, n)
+		mk := ManifestKey{Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Meta: recordsSum(recs)}
+		if m != nil {
+			m.setKey(n, mk)
+		}
+		if !b.changedSince(n, mk, sc, base) {
+			continue
+		}
+		var hdr *tar.Header
+		if hdr, err = tar.FileInfoHeader(fi, ""); err != nil {
+			return out, err
+		}
+		hdr.Name = tarPath
+		hdr.PAXRecords = recs
+		hdr.Format = tar.FormatPAX
+		out = append(out, exportEntry{hdr: hdr, pin: b.db.snaps.pin(b.filePath(fi.Name()))})
+	}
+
+	for _, cb := range b.buckets {
+		if out, err = cb.snapshot(ctx, out, sc); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+// changedSince returns true if key changed since what sc is exporting from, mk is how it is now, b.mux must be held.
+func (b *bucket) changedSince(key string, mk ManifestKey, sc *exportScope, base *ManifestBucket) bool {
+	switch {
+	case base != nil:
+		old, ok := base.Keys[key]
+		return !ok || old != mk
+	case sc.since > 0:
+		return mk.ModTime > sc.since || b.meta.Changed[key] > sc.since
+	}
+	return true
+}
+
+// tombstones appends the tombstones of the keys and child buckets deleted since what sc is exporting from,
+// a bucket deleted and created again gets one too, so Import drops what it had before, b.mux must be held.
+func (b *bucket) tombstones(out []exportEntry, names []string, sc *exportScope, base *ManifestBucket) []exportEntry {
+	var keys, buckets []string
+	switch {
+	case base != nil:
+		for n := range base.Buckets {
+			if b.buckets[n] == nil {
+				buckets = append(buckets, n)
+			}
+		}
+		for n := range base.Keys {
+			if _, ok := b.keys.Get(n); !ok {
+				keys = append(keys, n)
+			}
+		}
+	case sc.since > 0:
+		for n, ts := range b.meta.DeletedBuckets {
+			if ts > sc.since {
+				buckets = append(buckets, n)
+			}
+		}
+		for n, ts := range b.meta.Changed {
+			if _, ok := b.keys.Get(n); !ok && ts > sc.since {
+				keys = append(keys, n)
+			}
+		}
+	}
+	sort.Strings(buckets)
+	sort.Strings(keys)
+	names = names[:len(names):len(names)]
+	for _, n := range buckets {
+		if cnames := append(names, n); !sc.excluded(strings.Join(cnames, "/")) {
+			out = append(out, exportEntry{hdr: tombstoneHeader(cnames, true)})
+		}
+	}
+	for _, n := range keys {
+		if knames := append(names, n); !sc.excluded(strings.Join(knames, "/")) {
+			out = append(out, exportEntry{hdr: tombstoneHeader(knames, false)})
+		}
+	}
+	return out
+}
+
+// tombstoneHeader returns the entry telling Import to delete the key, or the bucket if isBucket is set, at names.
+func tombstoneHeader(names []string, isBucket bool) *tar.Header {
+	hdr := &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       strings.Join(names, "/"),
+		Mode:       0o644,
+		ModTime:    time.Now(),
+		PAXRecords: map[string]string{paxPath: pathRecord(names), paxDeleted: "1"},
+		Format:     tar.FormatPAX,
+	}
+	if isBucket {
+		hdr.Typeflag, hdr.Name, hdr.Mode = tar.TypeDir, hdr.Name+"/", 0o755
+	}
+	return hdr
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// writeEntries writes the entries captured by snapshot to tw, releasing them as it goes, or all of them on errors.
+func (db *DB) writeEntries(ctx context.Context, tw *tar.Writer, entries []exportEntry) (err error) {
+	for i, e := range entries {
+		if err = ctx.Err(); err == nil {
+			err = db.writeEntry(ctx, tw, e)
+		}
+		if err != nil {
+			db.releaseEntries(entries[i+1:])
+			return
+		}
+	}
+	return
+}
+
+// writeEntry only copies the size the key had when it was captured, appends write to the file in place.
+func (db *DB) writeEntry(ctx context.Context, tw *tar.Writer, e exportEntry) (err error) {
+	if e.pin == nil {
+		return tw.WriteHeader(e.hdr)
+	}
+	var f File
+	if f, err = db.snaps.open(e.pin); err != nil {
+		return
+	}
+	defer f.Close()
+	if err = tw.WriteHeader(e.hdr); err != nil {
+		return
+	}
+	_, err = io.Copy(tw, withContext(ctx, io.NewSectionReader(f, 0, e.hdr.Size)))
+	return
+}
+
+func (db *DB) releaseEntries(entries []exportEntry) {
+	for _, e := range entries {
+		if e.pin != nil {
+			db.snaps.unpin(e.pin)
+		}
+	}
+}
+
+// keyRecords returns the PAX records of key, names are the ones of the bucket, b.mux must be held.
+func (b *bucket) keyRecords(names []string, key string) map[string]string {
+	recs := map[string]string{
+		paxPath:   pathRecord(append(names[:len(names):len(names)], key)),
+		paxExpiry: strconv.FormatInt(b.meta.ExpiryDate[key], 10),
+	}
+	if s := b.meta.Sliding[key]; s > 0 {
+		recs[paxSliding] = strconv.FormatInt(s, 10)
+	}
+	if extra := b.meta.Extra[key]; len(extra) > 0 {
+		j, _ := json.Marshal(extra)
+		recs[paxExtra] = string(j)
+	}
+	return recs
+}
+
+// bucketHeader returns the directory entry of the bucket, b.mux must be held.
+func (b *bucket) bucketHeader(names []string) *tar.Header {
+	name := strings.Join(names, "/")
+	if name == "" {
+		name = "."
+	}
+	recs := map[string]string{
+		paxPath:    pathRecord(names),
+		paxCounter: b.meta.Counter.String(),
+	}
+	if b.meta.DefaultTTL > 0 {
+		recs[paxDefaultTTL] = strconv.FormatInt(b.meta.DefaultTTL, 10)
+	}
+	if b.meta.BucketExpiry > 0 {
+		recs[paxBucketExpiry] = strconv.FormatInt(b.meta.BucketExpiry, 10)
+	}
+	if len(b.meta.Archive) > 0 {
+		j, _ := json.Marshal(b.meta.Archive)
+		recs[paxArchive] = string(j)
+	}
+	return &tar.Header{
+		Typeflag:   tar.TypeDir,
+		Name:       name + "/",
+		Mode:       0o755,
+		ModTime:    time.Now(),
+		PAXRecords: recs,
+		Format:     tar.FormatPAX,
+	}
+}
+
+func pathRecord(names []string) string {
+	if len(names) == 0 {
+		return "[]"
+	}
+	j, _ := json.Marshal(names)
+	return string(j)
+}
+
+// entryNames returns the bucket names, followed by the key for files, of an archive entry.
+func entryNames(hdr *tar.Header) (names []string, err error) {
+	if s, ok := hdr.PAXRecords[paxPath]; ok {
+		if json.Unmarshal([]byte(s), &names) != nil {
+			return nil, ErrInvalidArchive
+		}
+		return
+	}
+	for _, n := range strings.Split(hdr.Name, "/") {
+		if n != "" && n != "." {
+			names = append(names, n)
+		}
+	}
+	return
+}
+
+// importPath returns the bucket at names under b, creating it if needed.
+func (b *bucket) importPath(names []string) (*bucket, error) {
+	if len(names) == 0 {
+		return b, nil
+	}
+	nb, err := b.CreateBucket(names...)
+	if err != nil {
+		return nil, err
+	}
+	return nb.(*bucket), nil
+}
+
+// importedBucket holds what Import restores once it's done with the keys,
+// writing them changes the counter and the bucket could expire halfway.
+type importedBucket struct {
+	b       *bucket
+	counter *big.Int
+	expiry  int64
+}
+
+// importBucket restores the default TTL and archive of the bucket from the records of its directory entry.
+func (b *bucket) importBucket(recs map[string]string) (ib importedBucket, err error) {
+	ib.b = b
+	var ttl int64
+	if s, ok := recs[paxCounter]; ok {
+		var valid bool
+		if ib.counter, valid = new(big.Int).SetString(s, 10); !valid {
+			return ib, ErrInvalidArchive
+		}
+	}
+	if ttl, err = parseRecord(recs, paxDefaultTTL); err != nil {
+		return
+	}
+	if ib.expiry, err = parseRecord(recs, paxBucketExpiry); err != nil {
+		return
+	}
+	var archive []string
+	if s, ok := recs[paxArchive]; ok {
+		if json.Unmarshal([]byte(s), &archive) != nil {
+			return ib, ErrInvalidArchive
+		}
+	}
+
+	defer func() { // registered first so it runs after the lock is released
+		if err == nil {
+			err = b.db.fsyncDir(b.path)
+		}
+	}()
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	defer b.unlockWrite()
+	b.meta.DefaultTTL, b.meta.Archive = ttl, archive
+	return ib, b.meta.store()
+}
+
+// restore restores the counter and expiry of the bucket.
+func (ib importedBucket) restore() (err error) {
+	if ib.counter != nil {
+		if err = func() error {
+			if err := ib.b.lockWrite(); err != nil {
+				return err
+			}
+			defer ib.b.unlockWrite()
+			ib.b.meta.Counter.Set(ib.counter)
+			return ib.b.meta.store()
+		}(); err != nil {
+			return
+		}
+		if err = ib.b.db.fsyncDir(ib.b.path); err != nil {
+			return
+		}
+	}
+	if ib.expiry > 0 && ib.b.parent != nil {
+		return ib.b.ExpireBucketAt(time.Unix(ib.expiry, 0))
+	}
+	return
+}
+
+// importKey stores r as key, restoring the metadata in recs if the archive has it.
+func (b *bucket) importKey(ctx context.Context, key string, r io.Reader, recs map[string]string) (err error) {
+	if _, ok := recs[paxExpiry]; !ok {
+		return b.PutContext(ctx, key, r)
+	}
+
+	var (
+		exp, sliding int64
+		extra        map[string]string
+	)
+	if exp, err = parseRecord(recs, paxExpiry); err != nil {
+		return
+	}
+	if sliding, err = parseRecord(recs, paxSliding); err != nil {
+		return
+	}
+	if s, ok := recs[paxExtra]; ok {
+		if json.Unmarshal([]byte(s), &extra) != nil {
+			return ErrInvalidArchive
+		}
+	}
+
+	fn := func(w io.Writer) error { _, err := io.Copy(w, withContext(ctx, r)); return err }
+	if err = b.putTimedFunc(ctx, key, fn, NoTTL); err != nil {
+		return
+	}
+
+	defer func() { // registered first so it runs after the lock is released
+		if err == nil {
+			err = b.db.fsyncDir(b.path)
+		}
+	}()
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	defer b.unlockWrite()
+	if exp == 0 && len(extra) == 0 && len(b.meta.Extra[key]) == 0 {
+		return // nothing to restore, the put already removed any expiry
+	}
+	if exp != 0 {
+		b.setExpiryAt(key, time.Unix(exp, 0))
+		b.meta.SetSliding(key, time.Duration(sliding))
+	}
+	if b.meta.Extra != nil {
+		delete(b.meta.Extra, key)
+	}
+	for k, v := range extra {
+		b.meta.SetExtraData(key, k, v)
+	}
+	return b.meta.store()
+}
+
+// importTombstone deletes the key, or the bucket if isBucket is set, at names under b, if it's still there.
+func (b *bucket) importTombstone(names []string, isBucket bool) (err error) {
+	if len(names) == 0 {
+		return // the root bucket can't be deleted
+	}
+	pb, ok := b.Bucket(names[:len(names)-1]...).(*bucket)
+	if !ok {
+		return
+	}
+	if n := names[len(names)-1]; isBucket {
+		err = pb.DeleteBucket(n)
+	} else {
+		err = pb.Delete(n)
+	}
+	if errors.Is(err, ErrNotFound) {
+		err = nil
+	}
+	return
+}
+
+// parseRecord returns the int64 in recs[k], 0 if it isn't set.
+func parseRecord(recs map[string]string, k string) (int64, error) {
+	s, ok := recs[k]
+	if !ok {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidArchive
+	}
+	return n, nil
+}
@@ -4,32 +4,75 @@ import (
 	"io"
 	"os"
 	"sync"
-	"syscall"
 )
 
 type Reader struct {
 	f      *file
+	st     os.FileInfo // taken when the reader was opened, other readers of the key share f
+	ops    *opTracker  // Close waits for open readers
 	offset int64
 }
 
 func (r *Reader) Read(p []byte) (n int, err error) {
-	if n, err = syscall.Pread(r.f.Fd(), p, r.offset); err == nil && n == 0 {
-		err = io.EOF
+	if n, err = r.f.f.ReadAt(p, r.offset); err == io.EOF && n > 0 {
+		err = nil
 	}
 	r.offset += int64(n)
 	return
 }
 
+// ReadAt implements io.ReaderAt, it doesn't change the offset used by Read.
+func (r *Reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, ErrNegativeOffset
+	}
+	return r.f.f.ReadAt(p, off)
+}
+
+// Seek implements io.Seeker, io.SeekEnd is relative to Size.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.Size()
+	default:
+		return 0, ErrInvalidWhence
+	}
+	if offset < 0 {
+		return 0, ErrNegativeOffset
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Size returns the size of the file when the reader was opened, it's a snapshot,
+// anything appended since doesn't change it, even though Read and ReadAt can still return it.
+func (r *Reader) Size() int64 {
+	return r.st.Size()
+}
+
 func (r *Reader) Close() error {
+	if r.ops == nil { // already closed
+		return nil
+	}
 	r.f.close()
+	r.ops.end()
+	r.ops = nil
 	return nil
 }
 
+// Stat returns the FileInfo of the file when the reader was opened, see Size.
 func (r *Reader) Stat() os.FileInfo {
-	return r.f.st
+	return r.st
 }
 
-var _ io.ReadCloser = (*Reader)(nil)
+var (
+	_ io.ReadCloser = (*Reader)(nil)
+	_ io.ReaderAt   = (*Reader)(nil)
+	_ io.Seeker     = (*Reader)(nil)
+)
 
 func newROFile(path string, fs *files) *file {
 	return &file{
@@ -39,18 +82,13 @@ func newROFile(path string, fs *files) *file {
 }
 
 type file struct {
-	st      os.FileInfo
-	f       *os.File
+	f       File
 	fs      *files
 	p       string
 	mux     sync.Mutex
 	readers int16
 }
 
-func (f *file) Fd() int {
-	return int(f.f.Fd())
-}
-
 func (f *file) close() {
 	f.mux.Lock()
 	f.readers--
@@ -66,31 +104,37 @@ func (f *file) Reader() (r *Reader, err error) {
 	f.mux.Lock()
 	defer f.mux.Unlock()
 	if f.f == nil {
-		if f.f, err = os.Open(f.p); err != nil {
+		if f.f, err = f.fs.fsys.Open(f.p); err != nil {
 			if os.IsNotExist(err) {
 				f.fs.Delete(f.p)
-				err = os.ErrNotExist
+				err = ErrNotFound
 			}
 			return
 		}
-		if f.st, err = f.f.Stat(); err != nil {
+	}
+	// every reader gets its own, the file could have been appended to since the others opened it
+	var st os.FileInfo
+	if st, err = f.f.Stat(); err != nil {
+		if f.readers == 0 {
 			f.f.Close()
 			f.f = nil
-			return
 		}
+		return
 	}
 	f.readers++
-	r = &Reader{f: f}
+	r = &Reader{f: f, st: st}
 	return
 }
 
-func newFiles() *files {
-	return &files{m: map[string]*file{}}
+func newFiles(fsys FS, ops *opTracker) *files {
+	return &files{m: map[string]*file{}, fsys: fsys, ops: ops}
 }
 
 type files struct {
-	m   map[string]*file
-	mux sync.RWMutex
+	m    map[string]*file
+	fsys FS
+	ops  *opTracker
+	mux  sync.RWMutex
 }
 
 func (fs *files) Get(path string) (rc *Reader, err error) {
@@ -106,7 +150,11 @@ func (fs *files) Get(path string) (rc *Reader, err error) {
 		}
 		fs.mux.Unlock()
 	}
-	return f.Reader()
+	if rc, err = f.Reader(); err == nil {
+		fs.ops.add()
+		rc.ops = fs.ops
+	}
+	return
 }
 
 func (fs *files) Delete(path string) {
@@ -1,8 +1,8 @@
 package iodb
 
 import (
+	"context"
 	"io"
-	"os"
 	"time"
 
 	"github.com/alpineiq/iodb/mw"
@@ -37,6 +37,20 @@ func (g *group) Get(key string, mws ...mw.Middleware) (rc io.ReadCloser, err err
 	return g.bucket.Get(key, g.mw...)
 }
 
+func (g *group) GetContext(ctx context.Context, key string, mws ...mw.Middleware) (rc io.ReadCloser, err error) {
+	if len(mws) > 0 {
+		return g.bucket.GetContext(ctx, key, mws...)
+	}
+	return g.bucket.GetContext(ctx, key, g.mw...)
+}
+
+func (g *group) GetRange(key string, off, n int64, mws ...mw.Middleware) (rc io.ReadCloser, err error) {
+	if len(mws) > 0 {
+		return g.bucket.GetRange(key, off, n, mws...)
+	}
+	return g.bucket.GetRange(key, off, n, g.mw...)
+}
+
 func (g *group) GetAndDelete(key string, fn func(r io.Reader) error, mws ...mw.Middleware) (err error) {
 	if len(mws) > 0 {
 		return g.bucket.GetAndDelete(key, fn, mws...)
@@ -72,6 +86,13 @@ func (g *group) Put(key string, r io.Reader, mws ...mw.Middleware) (err error) {
 	return g.bucket.Put(key, r, g.mw...)
 }
 
+func (g *group) PutContext(ctx context.Context, key string, r io.Reader, mws ...mw.Middleware) (err error) {
+	if len(mws) > 0 {
+		return g.bucket.PutContext(ctx, key, r, mws...)
+	}
+	return g.bucket.PutContext(ctx, key, r, g.mw...)
+}
+
 func (g *group) PutTimed(key string, r io.Reader, expiry time.Duration, mws ...mw.Middleware) (err error) {
 	if len(mws) > 0 {
 		return g.bucket.PutTimed(key, r, expiry, mws...)
@@ -93,6 +114,13 @@ func (g *group) Append(key string, r io.Reader, mws ...mw.Middleware) (err error
 	return g.bucket.Append(key, r, g.mw...)
 }
 
+func (g *group) AppendContext(ctx context.Context, key string, r io.Reader, mws ...mw.Middleware) (err error) {
+	if len(mws) > 0 {
+		return g.bucket.AppendContext(ctx, key, r, mws...)
+	}
+	return g.bucket.AppendContext(ctx, key, r, g.mw...)
+}
+
 func (g *group) ForEach(fn func(key string, value io.Reader) error, mws ...mw.Middleware) error {
 	if len(mws) > 0 {
 		return g.bucket.ForEach(fn, mws...)
@@ -100,6 +128,13 @@ func (g *group) ForEach(fn func(key string, value io.Reader) error, mws ...mw.Mi
 	return g.bucket.ForEach(fn, g.mw...)
 }
 
+func (g *group) ForEachContext(ctx context.Context, fn func(key string, value io.Reader) error, mws ...mw.Middleware) error {
+	if len(mws) > 0 {
+		return g.bucket.ForEachContext(ctx, fn, mws...)
+	}
+	return g.bucket.ForEachContext(ctx, fn, g.mw...)
+}
+
 func (g *group) ForEachReverse(fn func(key string, value io.Reader) error, mws ...mw.Middleware) error {
 	if len(mws) > 0 {
 		return g.bucket.ForEachReverse(fn, mws...)
@@ -111,13 +146,6 @@ func (g *group) Group(mws ...mw.Middleware) Bucket {
 	return &group{g.bucket, mws}
 }
 
-func (g *group) Stat(key string) (fi os.FileInfo, err error) {
-	var ok bool
-	g.mux.RLock()
-	if fi, ok = g.keys[key]; !ok {
-		err = ErrFileDoesNotExist
-	}
-
-	g.mux.RUnlock()
-	return
+func (g *group) Cursor(opts *CursorOptions) *Cursor {
+	return newCursor(g.bucket, g, opts)
 }
@@ -2,9 +2,14 @@ package iodb
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 	"sync/atomic"
 
 	"go.oneofone.dev/oerrs"
@@ -25,6 +30,42 @@ const (
 
 	// ErrSamePath is returned when the same path is used for a bucket
 	ErrSamePath = oerrs.String("same path")
+
+	// ErrNegativeOffset is returned when seeking or reading before the start of a value
+	ErrNegativeOffset = oerrs.String("negative offset")
+
+	// ErrInvalidWhence is returned when Seek is called with an invalid whence
+	ErrInvalidWhence = oerrs.String("invalid whence")
+
+	// ErrNotSeekable is returned when seeking on a value read through middleware that doesn't support it
+	ErrNotSeekable = oerrs.String("middleware doesn't support seeking")
+
+	// ErrNotAppendable is returned (wrapped in a *MiddlewareError) when appending through middleware that doesn't support it
+	ErrNotAppendable = oerrs.String("middleware doesn't support appending")
+
+	// ErrInvalidToken is returned when List is called with a malformed token or one from a different listing
+	ErrInvalidToken = oerrs.String("invalid list token")
+
+	// ErrRootBucket is returned when trying to expire the root bucket
+	ErrRootBucket = oerrs.String("the root bucket can't expire")
+
+	// ErrInvalidKey is returned (wrapped in a *KeyError) for keys that can't be stored
+	ErrInvalidKey = oerrs.String("invalid key")
+
+	// ErrInvalidName is returned by KeyEncoder.Decode for names it couldn't have returned from Encode
+	ErrInvalidName = oerrs.String("invalid encoded name")
+
+	// ErrInvalidArchive is returned by Import for archives with malformed metadata
+	ErrInvalidArchive = oerrs.String("invalid archive")
+
+	// ErrSinceTooOld is returned by ExportWithOptions for a Since further back than Options.ChangeRetention
+	ErrSinceTooOld = oerrs.String("since is older than the change retention")
+
+	// ErrNoManifest is returned by ReadManifest for archives that weren't written by ExportWithOptions
+	ErrNoManifest = oerrs.String("archive has no manifest")
+
+	// ErrUnknownArchiveFormat is returned by ImportFile for files it can't tell the format of
+	ErrUnknownArchiveFormat = oerrs.String("not a tar, gzip or snappy archive, flate archives need a .flate or .deflate suffix")
 )
 
 func b64EncodeName(p string) string {
@@ -54,57 +95,46 @@ func (b buckets) Sort(rev bool) []string {
 	return []string(out)
 }
 
-type keyList map[string]os.FileInfo
-
-func (k keyList) Names(rev bool) []string {
-	out := make(sort.StringSlice, 0, len(k))
-	for n := range k {
-		out = append(out, n)
-	}
-	if rev {
-		sort.Sort(sort.Reverse(out))
-	} else {
-		sort.Sort(out)
-	}
-	return []string(out)
-}
-
-func (k keyList) Paths(rev bool) []string {
-	out := make(sort.StringSlice, 0, len(k))
-	for _, p := range k {
-		out = append(out, p.Name())
-	}
-	if rev {
-		sort.Sort(sort.Reverse(out))
-	} else {
-		sort.Sort(out)
-	}
-	return []string(out)
-}
-
 var tmpFileCounter uint64
 
+// tmpFileName returns a hidden temp file name next to path, hidden so it never shows up as a key.
 func tmpFileName(path string) string {
-	return path + ".tmp." + strconv.FormatUint(atomic.AddUint64(&tmpFileCounter, 1), 16)
+	dir, fn := filepath.Split(path)
+	return filepath.Join(dir, "."+fn+tmpSuffix+strconv.FormatUint(atomic.AddUint64(&tmpFileCounter, 1), 16))
 }
 
-func lsDir(dir string) (files, dirs []os.FileInfo, err error) {
-	var f *os.File
-	if f, err = os.Open(dir); err != nil {
-		return
+const tmpSuffix = ".tmp."
+
+// isTempFile reports whether fn looks like a file left behind by tmpFileName,
+// legacy is set for temp files created before they were hidden.
+func isTempFile(fn string) (ok, legacy bool) {
+	i := strings.LastIndex(fn, tmpSuffix)
+	if i < 1 {
+		return false, false
 	}
-	defer f.Close()
-	var st os.FileInfo
-	if st, err = f.Stat(); err != nil || !st.IsDir() {
-		return
+	for _, c := range fn[i+len(tmpSuffix):] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false, false
+		}
+	}
+	if len(fn) == i+len(tmpSuffix) {
+		return false, false
 	}
-	var fis []os.FileInfo
-	if fis, err = f.Readdir(-1); err != nil {
+	return true, fn[0] != '.'
+}
+
+func lsDir(fsys FS, dir string) (files, dirs []os.FileInfo, err error) {
+	var des []fs.DirEntry
+	if des, err = fsys.ReadDir(dir); err != nil {
 		return
 	}
 
-	for _, fi := range fis {
-		if fn := fi.Name(); len(fn) == 0 || fn[0] == '.' {
+	for _, de := range des {
+		if fn := de.Name(); len(fn) == 0 || fn[0] == '.' {
+			continue
+		}
+		fi, ierr := de.Info()
+		if ierr != nil { // deleted between ReadDir and Info
 			continue
 		}
 		switch {
@@ -117,3 +147,71 @@ func lsDir(dir string) (files, dirs []os.FileInfo, err error) {
 
 	return
 }
+
+// writeFileSync atomically replaces path with data, syncing both the file and its directory.
+func writeFileSync(fsys FS, path string, data []byte) (err error) {
+	var (
+		tmpPath = path + ".tmp"
+		f       File
+	)
+	if f, err = fsys.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644); err != nil {
+		return
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = fsys.Rename(tmpPath, path)
+	}
+	if err != nil {
+		fsys.Remove(tmpPath)
+		return
+	}
+	return syncDir(fsys, filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory so renames and removals inside it are durable.
+func syncDir(fsys FS, dir string) error {
+	f, err := fsys.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncCloser syncs the file before closing it.
+type syncCloser struct {
+	File
+}
+
+func (sc syncCloser) Close() error {
+	err := sc.File.Sync()
+	if cerr := sc.File.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func readFile(fsys FS, path string) ([]byte, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func readJSONFile(fsys FS, path string, v any) error {
+	b, err := readFile(fsys, path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
@@ -4,22 +4,53 @@
 package iodb
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alpineiq/iodb/mw"
 	"github.com/alpineiq/iodb/mw/common"
 	"github.com/alpineiq/iodb/mw/compressors"
+	"go.oneofone.dev/oerrs"
 )
 
 // TODO: clean this up, too much repeated code.
 
-func TestConcurrentPutGet(t *testing.T) {
+// testFileSystems lists the filesystems every test in this file runs against.
+var testFileSystems = []struct {
+	name string
+	new  func() FS
+}{
+	{"os", OSFS},
+	{"mem", NewMemFS},
+}
+
+func forEachFS(t *testing.T, fn func(t *testing.T, fsys FS)) {
+	for _, tfs := range testFileSystems {
+		fsys := tfs.new()
+		t.Run(tfs.name, func(t *testing.T) { fn(t, fsys) })
+	}
+}
+
+func TestConcurrentPutGet(t *testing.T) { forEachFS(t, testConcurrentPutGet) }
+
+func testConcurrentPutGet(t *testing.T, fsys FS) {
 	tmpDir, err := os.MkdirTemp("", "iodb-TestConcurrentPutGet")
 	if err != nil {
 		t.Fatal(err)
@@ -28,11 +59,11 @@ func TestConcurrentPutGet(t *testing.T) {
 		defer os.RemoveAll(tmpDir)
 	}
 
-	db, err := New(tmpDir, nil)
+	db, err := New(tmpDir, &Options{FS: fsys})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 	b, err := db.CreateBucket("TestConcurrentPutGet", "Test")
 	if err != nil {
 		t.Fatal(err)
@@ -77,7 +108,9 @@ func TestConcurrentPutGet(t *testing.T) {
 	t.Logf("buckets: %v", db.Bucket().Buckets(false))
 }
 
-func TestMiddlewareGroups(t *testing.T) {
+func TestMiddlewareGroups(t *testing.T) { forEachFS(t, testMiddlewareGroups) }
+
+func testMiddlewareGroups(t *testing.T, fsys FS) {
 	tmpDir, err := os.MkdirTemp("", "iodb-TestMiddlewareGroups")
 	if err != nil {
 		t.Fatal(err)
@@ -86,11 +119,11 @@ func TestMiddlewareGroups(t *testing.T) {
 		defer os.RemoveAll(tmpDir)
 	}
 
-	db, err := New(tmpDir, nil)
+	db, err := New(tmpDir, &Options{FS: fsys})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 
 	// yes double compression is pointless but we're just testing the middleware.
 	g := db.Group(compressors.NewFlate(9), compressors.NewGzip(9), common.NewBase64())
@@ -115,7 +148,9 @@ func TestMiddlewareGroups(t *testing.T) {
 	}
 }
 
-func TestChainBucket(t *testing.T) {
+func TestChainBucket(t *testing.T) { forEachFS(t, testChainBucket) }
+
+func testChainBucket(t *testing.T, fsys FS) {
 	tmpDir, err := os.MkdirTemp("", "iodb-TestChainBucket")
 	if err != nil {
 		t.Fatal(err)
@@ -123,11 +158,11 @@ func TestChainBucket(t *testing.T) {
 	if !keepTmp {
 		defer os.RemoveAll(tmpDir)
 	}
-	db, err := New(tmpDir, nil)
+	db, err := New(tmpDir, &Options{FS: fsys})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 	b1, err := db.CreateBucket("b1", "b2", "b3")
 	if err != nil {
 		t.Fatal(err)
@@ -141,7 +176,9 @@ func TestChainBucket(t *testing.T) {
 	t.Logf("path: %s, name: %v", b1.Path(), b1.Name())
 }
 
-func TestBugCantListBucketsAndKeys(t *testing.T) {
+func TestBugCantListBucketsAndKeys(t *testing.T) { forEachFS(t, testBugCantListBucketsAndKeys) }
+
+func testBugCantListBucketsAndKeys(t *testing.T, fsys FS) {
 	tmpDir, err := os.MkdirTemp("", "iodb-TestChainBucket")
 	if err != nil {
 		t.Fatal(err)
@@ -149,11 +186,11 @@ func TestBugCantListBucketsAndKeys(t *testing.T) {
 	if !keepTmp {
 		defer os.RemoveAll(tmpDir)
 	}
-	db, err := New(tmpDir, nil)
+	db, err := New(tmpDir, &Options{FS: fsys})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 
 	if _, err = db.CreateBucket("b1", "b2"); err != nil {
 		t.Fatal(err)
@@ -185,7 +222,9 @@ func TestBugCantListBucketsAndKeys(t *testing.T) {
 	t.Logf("Bucket (%s): %q %q", b.Name(), b.Buckets(true), b.Keys(true))
 }
 
-func TestTimedKey(t *testing.T) {
+func TestTimedKey(t *testing.T) { forEachFS(t, testTimedKey) }
+
+func testTimedKey(t *testing.T, fsys FS) {
 	tmpDir, err := os.MkdirTemp("", "iodb-TestTimedBucket")
 	if err != nil {
 		t.Fatal(err)
@@ -193,11 +232,11 @@ func TestTimedKey(t *testing.T) {
 	if !keepTmp {
 		defer os.RemoveAll(tmpDir)
 	}
-	db, err := New(tmpDir, nil)
+	db, err := New(tmpDir, &Options{FS: fsys})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 	b, err := db.CreateBucket("TestTimed")
 	if err != nil {
 		t.Fatal(err)
@@ -218,12 +257,14 @@ func TestTimedKey(t *testing.T) {
 	}
 	time.Sleep(time.Second / 2)
 
-	if _, err = b.Get("license"); err != os.ErrNotExist {
+	if _, err = b.Get("license"); !errors.Is(err, ErrNotFound) {
 		t.Fatal("file didn't get deleted")
 	}
 }
 
-func TestTimedKeyBucketReload(t *testing.T) {
+func TestTimedKeyBucketReload(t *testing.T) { forEachFS(t, testTimedKeyBucketReload) }
+
+func testTimedKeyBucketReload(t *testing.T, fsys FS) {
 	tmpDir, err := os.MkdirTemp("", "iodb-TestTimedBucket")
 	if err != nil {
 		t.Fatal(err)
@@ -231,7 +272,7 @@ func TestTimedKeyBucketReload(t *testing.T) {
 	if !keepTmp {
 		defer os.RemoveAll(tmpDir)
 	}
-	db, err := New(tmpDir, nil)
+	db, err := New(tmpDir, &Options{FS: fsys})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -244,21 +285,23 @@ func TestTimedKeyBucketReload(t *testing.T) {
 	if err = b.PutTimed("license", strings.NewReader(data), time.Second/4); err != nil {
 		t.Fatalf("%v", err)
 	}
-	db.Close()
+	db.Close(context.Background())
 
 	time.Sleep(time.Second / 2)
 
-	if db, err = New(tmpDir, nil); err != nil {
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 
-	if _, err = db.Bucket("TestTimed").Get("license"); err != os.ErrNotExist {
+	if _, err = db.Bucket("TestTimed").Get("license"); !errors.Is(err, ErrNotFound) {
 		t.Fatal("file didn't get deleted")
 	}
 }
 
-func TestAppend(t *testing.T) {
+func TestAppend(t *testing.T) { forEachFS(t, testAppend) }
+
+func testAppend(t *testing.T, fsys FS) {
 	const nums = "0123456789"
 	tmpDir, err := os.MkdirTemp("", "iodb-TestAppend")
 	if err != nil {
@@ -267,11 +310,11 @@ func TestAppend(t *testing.T) {
 	if !keepTmp {
 		defer os.RemoveAll(tmpDir)
 	}
-	db, err := New(tmpDir, nil)
+	db, err := New(tmpDir, &Options{FS: fsys})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 	b, err := db.CreateBucket("TestAppend")
 	if err != nil {
 		t.Fatal(err)
@@ -297,7 +340,9 @@ func TestAppend(t *testing.T) {
 	}
 }
 
-func TestGetAndDelete(t *testing.T) {
+func TestGetAndDelete(t *testing.T) { forEachFS(t, testGetAndDelete) }
+
+func testGetAndDelete(t *testing.T, fsys FS) {
 	tmpDir, err := os.MkdirTemp("", "iodb-TestGetDelete")
 	if err != nil {
 		t.Fatal(err)
@@ -305,11 +350,11 @@ func TestGetAndDelete(t *testing.T) {
 	if !keepTmp {
 		defer os.RemoveAll(tmpDir)
 	}
-	db, err := New(tmpDir, nil)
+	db, err := New(tmpDir, &Options{FS: fsys})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 	b, err := db.CreateBucket("TestGetDelete")
 	if err != nil {
 		t.Fatal(err)
@@ -326,12 +371,14 @@ func TestGetAndDelete(t *testing.T) {
 	}); err != nil {
 		t.Fatal(err)
 	}
-	if _, err = b.Get("license"); err != os.ErrNotExist {
+	if _, err = b.Get("license"); !errors.Is(err, ErrNotFound) {
 		t.Fatal("found license, but we shouldn't have")
 	}
 }
 
-func TestGetAndRename(t *testing.T) {
+func TestGetAndRename(t *testing.T) { forEachFS(t, testGetAndRename) }
+
+func testGetAndRename(t *testing.T, fsys FS) {
 	var (
 		tmpDir string
 		db     *DB
@@ -348,11 +395,12 @@ func TestGetAndRename(t *testing.T) {
 	}
 
 	if db, err = New(tmpDir, &Options{
+		FS:             fsys,
 		PlainFileNames: true,
 	}); err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 
 	if b, err = db.CreateBucket("TestOrig"); err != nil {
 		t.Fatal(err)
@@ -376,7 +424,7 @@ func TestGetAndRename(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err = b.Get("license"); err != os.ErrNotExist {
+	if _, err = b.Get("license"); !errors.Is(err, ErrNotFound) {
 		t.Fatal("found license in original bucket, but we shouldn't have")
 	}
 
@@ -387,7 +435,106 @@ func TestGetAndRename(t *testing.T) {
 	rc.Close()
 }
 
-func TestRename(t *testing.T) {
+func TestRenameTTL(t *testing.T) { forEachFS(t, testRenameTTL) }
+
+func testRenameTTL(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestRenameTTL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.CreateBucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nb, err := db.CreateBucket("nb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.PutTimed("short", strings.NewReader(data), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Put("sliding", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.ExpireSliding("sliding", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = nb.PutTimed("plain", strings.NewReader(data), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Put("plain", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Rename("short", nb, "short2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.GetAndRename("sliding", b, "sliding2", false, func(r io.Reader) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	// overwriting a key replaces its expiry too
+	if err = b.Rename("plain", nb, "plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	if d, err := nb.TTL("short2"); err != nil || d <= 0 || d > time.Second {
+		t.Fatalf("short2 didn't keep its expiry: %v %v", d, err)
+	}
+	if d, err := b.TTL("sliding2"); err != nil || d <= 0 || d > time.Hour {
+		t.Fatalf("sliding2 didn't keep its expiry: %v %v", d, err)
+	}
+	if d, err := nb.TTL("plain"); err != nil || d != NoTTL {
+		t.Fatalf("plain kept the expiry of the key it replaced: %v %v", d, err)
+	}
+	for _, bkt := range []*bucket{b.(*bucket), nb.(*bucket)} {
+		if err = bkt.rlock(); err != nil {
+			t.Fatal(err)
+		}
+		if w := bkt.meta.Sliding["sliding2"]; bkt == b.(*bucket) && w != int64(time.Hour) {
+			t.Fatalf("sliding2 isn't sliding anymore: %v", time.Duration(w))
+		}
+		for _, k := range []string{"short", "sliding"} {
+			if _, ok := bkt.meta.ExpiryDate[k]; ok {
+				t.Fatalf("%s left its expiry behind", k)
+			}
+			if _, ok := bkt.meta.Sliding[k]; ok {
+				t.Fatalf("%s left its sliding window behind", k)
+			}
+		}
+		bkt.mux.RUnlock()
+	}
+
+	// the scheduler follows the key
+	time.Sleep(1500 * time.Millisecond)
+	if _, err = nb.Stat("short2"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("short2 didn't expire: %v", err)
+	}
+
+	// and so does the stored metadata
+	db.Close(context.Background())
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	if d, err := db.Bucket("b").TTL("sliding2"); err != nil || d <= 0 || d > time.Hour {
+		t.Fatalf("sliding2 didn't keep its expiry after reopening: %v %v", d, err)
+	}
+	if d, err := db.Bucket("nb").TTL("plain"); err != nil || d != NoTTL {
+		t.Fatalf("plain got its old expiry back after reopening: %v %v", d, err)
+	}
+}
+
+func TestRename(t *testing.T) { forEachFS(t, testRename) }
+
+func testRename(t *testing.T, fsys FS) {
 	var (
 		tmpDir string
 		db     *DB
@@ -404,11 +551,12 @@ func TestRename(t *testing.T) {
 	}
 
 	if db, err = New(tmpDir, &Options{
+		FS:             fsys,
 		PlainFileNames: true,
 	}); err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 
 	if b, err = db.CreateBucket("TestOrig"); err != nil {
 		t.Fatal(err)
@@ -426,7 +574,7 @@ func TestRename(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err = b.Get("license"); err != os.ErrNotExist {
+	if _, err = b.Get("license"); !errors.Is(err, ErrNotFound) {
 		t.Fatal("found license in original bucket, but we shouldn't have")
 	}
 
@@ -440,7 +588,7 @@ func TestRename(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err = nb.Get("license"); err != os.ErrNotExist {
+	if _, err = nb.Get("license"); !errors.Is(err, ErrNotFound) {
 		t.Fatal("found license in new bucket, but we shouldn't have")
 	}
 
@@ -450,7 +598,9 @@ func TestRename(t *testing.T) {
 	rc.Close()
 }
 
-func TestExport(t *testing.T) {
+func TestExport(t *testing.T) { forEachFS(t, testExport) }
+
+func testExport(t *testing.T, fsys FS) {
 	tmpDir, err := os.MkdirTemp("", "iodb-TestTimedBucket")
 	if err != nil {
 		t.Fatal(err)
@@ -460,11 +610,11 @@ func TestExport(t *testing.T) {
 	}
 
 	// create a new empty database
-	db, err := New(tmpDir, &Options{PlainFileNames: true})
+	db, err := New(tmpDir, &Options{FS: fsys, PlainFileNames: true})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 
 	// put license in the root bucket
 	if err = db.Bucket().Put("license", strings.NewReader(data)); err != nil {
@@ -500,23 +650,27 @@ func TestExport(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	db2, err := New(tmpDir+"/2", &Options{PlainFileNames: true})
+	db2, err := New(tmpDir+"/2", &Options{FS: fsys, PlainFileNames: true})
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer db2.Close()
+	defer db2.Close(context.Background())
 
 	if err := db2.Import(&buf); err != nil {
 		t.Fatal(err)
 	}
 
-	if _, err := db2.Bucket().Get("license"); err != nil {
+	rc, err := db2.Bucket().Get("license")
+	if err != nil {
 		t.Fatal(err)
 	}
+	rc.Close()
 
-	if _, err := db2.Bucket("Child Bucket").Get("license"); err != nil {
+	rc, err = db2.Bucket("Child Bucket").Get("license")
+	if err != nil {
 		t.Fatal(err)
 	}
+	rc.Close()
 
 	if b := db2.Bucket("Child Bucket", "Child Child Bucket"); b != nil {
 		t.Fatal("expected nil, got", b)
@@ -541,7 +695,9 @@ func TestExport(t *testing.T) {
 	// }
 }
 
-func TestStat(t *testing.T) {
+func TestStat(t *testing.T) { forEachFS(t, testStat) }
+
+func testStat(t *testing.T, fsys FS) {
 	var (
 		db     *DB
 		bkt    Bucket
@@ -556,10 +712,10 @@ func TestStat(t *testing.T) {
 	}
 	defer os.RemoveAll(tmpDir)
 
-	if db, err = New(tmpDir, nil); err != nil {
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
 		t.Fatal(err)
 	}
-	defer db.Close()
+	defer db.Close(context.Background())
 
 	if bkt, err = db.CreateBucket("TestStat"); err != nil {
 		t.Fatal(err)
@@ -593,3 +749,3101 @@ func TestStat(t *testing.T) {
 		t.Fatal("file info is being returned when it should be nil")
 	}
 }
+
+func TestUpdate(t *testing.T) { forEachFS(t, testUpdate) }
+
+func testUpdate(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestUpdate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	if err = db.Bucket().Put("old", strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := fmt.Errorf("abort")
+	if err = db.Update(func(tx *Tx) error {
+		if err := tx.Bucket("a").Put("k", strings.NewReader("v")); err != nil {
+			return err
+		}
+		return errAbort
+	}); err != errAbort {
+		t.Fatalf("expected errAbort, got %v", err)
+	}
+	if db.Bucket("a") != nil {
+		t.Fatal("rolled back transaction created a bucket")
+	}
+
+	if err = db.Update(func(tx *Tx) error {
+		a, b := tx.Bucket("a"), tx.Bucket("b", "c")
+		if err := a.Put("k", strings.NewReader("v")); err != nil {
+			return err
+		}
+		if err := a.SetExtraData("k", "x", "y"); err != nil {
+			return err
+		}
+		if err := tx.Bucket().Rename("old", b, "new"); err != nil {
+			return err
+		}
+		if err := b.Expire("new", time.Hour); err != nil {
+			return err
+		}
+		return b.Delete("missing")
+	}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if _, err = db.Bucket().Stat("old"); err != nil {
+		t.Fatal("failed transaction was applied")
+	}
+
+	// ops that could never be applied are rejected when they're staged
+	if err = db.Update(func(tx *Tx) error {
+		return tx.Bucket().Rename("old", nil, "old")
+	}); !errors.Is(err, ErrSamePath) {
+		t.Fatalf("expected ErrSamePath, got %v", err)
+	}
+	if err = db.Update(func(tx *Tx) error {
+		return db.Update(func(tx2 *Tx) error {
+			return tx.Bucket().Rename("old", tx2.Bucket(), "new")
+		})
+	}); !errors.Is(err, ErrInvalidBucketType) {
+		t.Fatalf("expected ErrInvalidBucketType, got %v", err)
+	}
+
+	if err = db.Update(func(tx *Tx) error {
+		a, b := tx.Bucket("a"), tx.Bucket("b", "c")
+		if err := a.Put("k", strings.NewReader("v")); err != nil {
+			return err
+		}
+		if err := a.SetExtraData("k", "x", "y"); err != nil {
+			return err
+		}
+		if err := tx.Bucket().Rename("old", b, "new"); err != nil {
+			return err
+		}
+		return b.Expire("new", time.Hour)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := db.Bucket("a").Get("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := readString(rc); s != "v" {
+		t.Fatalf("expected v, got %q", s)
+	}
+	rc.Close()
+	if v := db.Bucket("a").GetExtraData("k", "x"); v != "y" {
+		t.Fatalf("expected y, got %q", v)
+	}
+	if _, err = db.Bucket().Stat("old"); err == nil {
+		t.Fatal("old didn't get renamed")
+	}
+	if _, err = db.Bucket("b", "c").Stat("new"); err != nil {
+		t.Fatal(err)
+	}
+	if des, _ := fsys.ReadDir(tmpDir + "/" + txDirName); len(des) != 0 {
+		t.Fatalf("leftover transactions: %v", des)
+	}
+}
+
+func TestUpdateRecovery(t *testing.T) { forEachFS(t, testUpdateRecovery) }
+
+func testUpdateRecovery(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestUpdateRecovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate crashing right after the journal of the first transaction got written,
+	// and while the second transaction was still staging.
+	stage := func(id string, commit bool) {
+		tx := &Tx{db: db, dir: tmpDir + "/" + txDirName + "/" + id, exists: map[string]bool{}}
+		if err := fsys.MkdirAll(tx.dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Bucket("b").Put(id, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if !commit {
+			return
+		}
+		j, _ := json.Marshal(&txJournal{Ops: tx.ops})
+		if err := writeFileSync(fsys, tx.dir+"/"+txJournalName, j); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stage("committed", true)
+	stage("pending", false)
+
+	// an op that fails on every replay gets skipped instead of keeping New from opening the db.
+	tx := &Tx{db: db, dir: tmpDir + "/" + txDirName + "/broken", exists: map[string]bool{}}
+	if err = fsys.MkdirAll(tx.dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Bucket("b").Put("before", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	tx.ops = append(tx.ops, txOp{Op: txOpRename, Bucket: []string{"b"}, Key: "before", NBucket: []string{"b"}, NKey: "before"})
+	if err = tx.Bucket("b").Put("after", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	j, _ := json.Marshal(&txJournal{Ops: tx.ops})
+	if err = writeFileSync(fsys, tx.dir+"/"+txJournalName, j); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	b := db.Bucket("b")
+	if b == nil {
+		t.Fatal("committed transaction wasn't replayed")
+	}
+	if _, err = b.Stat("committed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Stat("pending"); err == nil {
+		t.Fatal("uncommitted transaction was applied")
+	}
+	for _, k := range []string{"before", "after"} {
+		if _, err = b.Stat(k); err != nil {
+			t.Fatalf("%s: %v", k, err)
+		}
+	}
+	if f := db.RecoveryReport().FailedTxnOps; len(f) != 1 || !strings.HasPrefix(f[0], "broken/1: ") {
+		t.Fatalf("expected the rename to fail, got %q", f)
+	}
+	if des, _ := fsys.ReadDir(tmpDir + "/" + txDirName); len(des) != 0 {
+		t.Fatalf("leftover transactions: %v", des)
+	}
+}
+
+func TestUpdateRecoveryMovedFile(t *testing.T) { forEachFS(t, testUpdateRecoveryMovedFile) }
+
+func testUpdateRecoveryMovedFile(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestUpdateRecoveryMovedFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.CreateBucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Put("other", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate crashing after commitFile moved the staged file in place but before it stored the metadata.
+	tx := &Tx{db: db, dir: tmpDir + "/" + txDirName + "/moved", exists: map[string]bool{}}
+	if err = fsys.MkdirAll(tx.dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err = tx.Bucket("b").PutTimed("k", strings.NewReader(data), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	j, _ := json.Marshal(&txJournal{Ops: tx.ops})
+	if err = writeFileSync(fsys, tx.dir+"/"+txJournalName, j); err != nil {
+		t.Fatal(err)
+	}
+	path := b.(*bucket).filePath(db.keyFileName("k"))
+	if err = fsys.Rename(tx.dir+"/"+tx.ops[0].Staged, path); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	b = db.Bucket("b")
+	if _, err = b.Stat("k"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := b.TTL("k"); err != nil || ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("the expiry wasn't replayed: %v %v", ttl, err)
+	}
+	if n := b.NextID().Int64(); n != 2 {
+		t.Fatalf("the counter wasn't replayed: %d", n)
+	}
+	if des, _ := fsys.ReadDir(tmpDir + "/" + txDirName); len(des) != 0 {
+		t.Fatalf("leftover transactions: %v", des)
+	}
+}
+
+func TestUpdatePanic(t *testing.T) { forEachFS(t, testUpdatePanic) }
+
+func testUpdatePanic(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestUpdatePanic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("expected a panic")
+			}
+		}()
+		db.Update(func(tx *Tx) error {
+			if err := tx.Bucket("b").Put("k", strings.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			panic("oops")
+		})
+	}()
+	if des, _ := fsys.ReadDir(tmpDir + "/" + txDirName); len(des) != 0 {
+		t.Fatalf("leftover transactions: %v", des)
+	}
+}
+
+func TestRecovery(t *testing.T) { forEachFS(t, testRecovery) }
+
+func testRecovery(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestRecovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !db.RecoveryReport().Empty() {
+		t.Fatalf("unexpected recovery: %v", db.RecoveryReport())
+	}
+	b, err := db.CreateBucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"k1", "k2"} {
+		if err = b.Put(k, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close(context.Background())
+
+	// simulate a crash in the middle of a couple of writes.
+	write := func(p, s string) {
+		f, err := fsys.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(s))
+		f.Close()
+	}
+	bp := b.Path()
+	write(tmpFileName(bp+"/"+b64EncodeName("k3")), "partial")
+	write(bp+"/"+b64EncodeName("k4")+".tmp.1f", "legacy partial")
+	write(bp+"/"+metaName, `{"counter": 2, "expiryD`)
+
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	rep := db.RecoveryReport()
+	t.Logf("recovery report:\n%v", rep)
+	if len(rep.RemovedTempFiles) != 2 || len(rep.QuarantinedFiles) != 1 || len(rep.RebuiltMeta) != 1 {
+		t.Fatalf("unexpected report: %#v", rep)
+	}
+	b = db.Bucket("b")
+	if keys := b.Keys(false); len(keys) != 2 {
+		t.Fatalf("expected [k1 k2], got %q", keys)
+	}
+	if n := b.NextID().Int64(); n != 2 {
+		t.Fatalf("expected the counter to be rebuilt to 2, got %d", n)
+	}
+	if des, _ := fsys.ReadDir(tmpDir + "/" + quarantineDirName + "/" + b64EncodeName("b")); len(des) != 1 {
+		t.Fatalf("expected the corrupt .meta to be quarantined, got %v", des)
+	}
+}
+
+func TestRecoveryKeepsKeys(t *testing.T) { forEachFS(t, testRecoveryKeepsKeys) }
+
+func testRecoveryKeepsKeys(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestRecoveryKeepsKeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	opts := &Options{FS: fsys, KeyEncoder: PlainKeys}
+	db, err := New(tmpDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// looks like a temp file from before they were hidden
+	if err = db.Bucket().Put("a.tmp.1", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+
+	if db, err = New(tmpDir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	rep := db.RecoveryReport()
+	if len(rep.KeptTempFiles) != 1 || len(rep.QuarantinedFiles) != 0 || len(rep.RemovedTempFiles) != 0 {
+		t.Fatalf("unexpected report: %#v", rep)
+	}
+	rc, err := db.Bucket().Get("a.tmp.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if h := hashString(rc); h != dataHash {
+		t.Fatalf("expected %s, got %s", dataHash, h)
+	}
+}
+
+// syncCountingFS counts how many times files get fsynced, and which ones.
+type syncCountingFS struct {
+	FS
+	syncs  int64
+	synced sync.Map
+}
+
+func (fs *syncCountingFS) Open(name string) (File, error) {
+	f, err := fs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountingFile{f, fs, name}, nil
+}
+
+func (fs *syncCountingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := fs.FS.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &syncCountingFile{f, fs, name}, nil
+}
+
+type syncCountingFile struct {
+	File
+	fs   *syncCountingFS
+	name string
+}
+
+func (f *syncCountingFile) Sync() error {
+	atomic.AddInt64(&f.fs.syncs, 1)
+	f.fs.synced.Store(filepath.Clean(f.name), true)
+	return f.File.Sync()
+}
+
+func TestSyncMode(t *testing.T) { forEachFS(t, testSyncMode) }
+
+func testSyncMode(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestSyncMode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+
+	const n = 20
+	for _, layout := range []Layout{LayoutFlat, LayoutSharded} {
+		for _, mode := range []SyncMode{SyncNone, SyncData, SyncFull, SyncBatch} {
+			cfs := &syncCountingFS{FS: fsys}
+			db, err := New(fmt.Sprintf("%s/%d-%d", tmpDir, layout, mode), &Options{
+				FS: cfs, SyncMode: mode, SyncBatchWindow: 10 * time.Millisecond, Layout: layout,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := db.CreateBucket("b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			base := atomic.LoadInt64(&cfs.syncs) // new sharded buckets store their metadata right away
+
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if err := b.Put(strconv.Itoa(i), strings.NewReader(data)); err != nil {
+						t.Error(err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			syncs := atomic.LoadInt64(&cfs.syncs) - base
+			switch {
+			case mode == SyncNone:
+				if syncs != 0 {
+					t.Fatalf("SyncNone: expected no syncs, got %d", syncs)
+				}
+			case mode == SyncData: // the value and the metadata
+				if syncs != 2*n {
+					t.Fatalf("SyncData: expected %d syncs, got %d", 2*n, syncs)
+				}
+			case layout == LayoutSharded: // the shard directories and the ones they're in, up to the bucket's
+				bp := b.(*bucket).path
+				for i := 0; i < n; i++ {
+					for dir := filepath.Dir(b.(*bucket).filePath(db.keyFileName(strconv.Itoa(i)))); ; dir = filepath.Dir(dir) {
+						if _, ok := cfs.synced.Load(dir); !ok {
+							t.Fatalf("%v: %s wasn't synced", mode, dir)
+						}
+						if dir == bp {
+							break
+						}
+					}
+				}
+			case mode == SyncFull: // plus the directory
+				if syncs != 3*n {
+					t.Fatalf("SyncFull: expected %d syncs, got %d", 3*n, syncs)
+				}
+			case mode == SyncBatch:
+				if syncs <= 2*n || syncs >= 3*n {
+					t.Fatalf("SyncBatch: expected the directory syncs to be shared, got %d syncs", syncs)
+				}
+			}
+
+			if err = b.Delete("0"); err != nil {
+				t.Fatal(err)
+			}
+			if len(b.Keys(false)) != n-1 {
+				t.Fatalf("expected %d keys, got %d", n-1, len(b.Keys(false)))
+			}
+			db.Close(context.Background())
+		}
+	}
+}
+
+func TestGetRange(t *testing.T) { forEachFS(t, testGetRange) }
+
+func testGetRange(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestGetRange")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	b := db.Bucket()
+	if err = b.Put("license", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Put("b64", strings.NewReader(data), common.NewBase64()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		key    string
+		off, n int64
+		mws    []mw.Middleware
+	}{
+		{"license", 100, 50, nil},
+		{"license", 100, -1, nil},
+		{"license", int64(len(data)) - 10, 50, nil},
+		{"b64", 100, 50, []mw.Middleware{common.NewBase64()}}, // not seekable, falls back to skipping
+	} {
+		rc, err := b.GetRange(tc.key, tc.off, tc.n, tc.mws...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		exp := data[tc.off:]
+		if tc.n >= 0 && int(tc.n) < len(exp) {
+			exp = exp[:tc.n]
+		}
+		if s := readString(rc); s != exp {
+			t.Fatalf("%+v: expected %q, got %q", tc, exp, s)
+		}
+		rc.Close()
+	}
+
+	rc, err := b.Get("license")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	rs, ok := rc.(io.ReadSeeker)
+	if !ok {
+		t.Fatalf("%T isn't an io.ReadSeeker", rc)
+	}
+
+	req := httptest.NewRequest("GET", "/license", nil)
+	req.Header.Set("Range", "bytes=10-19")
+	rw := httptest.NewRecorder()
+	http.ServeContent(rw, req, "license", time.Time{}, rs)
+	if rw.Code != http.StatusPartialContent || rw.Body.String() != data[10:20] {
+		t.Fatalf("unexpected response %d: %q", rw.Code, rw.Body.String())
+	}
+
+	// readers of the same key share the file, but each one's size is from when it was opened
+	if err = b.Append("license", strings.NewReader("more")); err != nil {
+		t.Fatal(err)
+	}
+	rc2, err := b.Get("license")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc2.Close()
+	type sizer interface{ Size() int64 }
+	if n := rc.(sizer).Size(); n != int64(len(data)) {
+		t.Fatalf("expected the first reader's size to stay %d, got %d", len(data), n)
+	}
+	if n := rc2.(sizer).Size(); n != int64(len(data)+4) {
+		t.Fatalf("expected %d, got %d", len(data)+4, n)
+	}
+}
+
+func TestSeekableCompression(t *testing.T) { forEachFS(t, testSeekableCompression) }
+
+// the codecs are tested in mw/compressors, this covers going through a bucket.
+func testSeekableCompression(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestSeekableCompression")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	comp := compressors.NewSeekableGzip(6, 1000)
+	b := db.Bucket().Group(comp)
+	if err = b.Put("license", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// crosses a block boundary
+	rc, err := b.GetRange("license", 990, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := readString(rc); s != data[990:1010] {
+		t.Fatalf("expected %q, got %q", data[990:1010], s)
+	}
+	ra, ok := rc.(io.ReaderAt)
+	if !ok {
+		t.Fatalf("%T isn't an io.ReaderAt", rc)
+	}
+	p := make([]byte, 5)
+	if _, err = ra.ReadAt(p, 15); err != nil || string(p) != data[1005:1010] {
+		t.Fatalf("expected %q, got %q (%v)", data[1005:1010], p, err)
+	}
+	rc.Close()
+
+	// appending would leave the index in the middle of the value
+	fi, _ := b.Stat("license")
+	var me *MiddlewareError
+	if err = b.Append("license", strings.NewReader("more")); !errors.Is(err, ErrNotAppendable) || !errors.As(err, &me) {
+		t.Fatalf("expected ErrNotAppendable, got %v", err)
+	}
+	if nfi, _ := b.Stat("license"); nfi.Size() != fi.Size() {
+		t.Fatalf("the value changed from %d to %d bytes", fi.Size(), nfi.Size())
+	}
+	if rc, err = b.Get("license"); err != nil {
+		t.Fatal(err)
+	}
+	if h := hashString(rc); h != dataHash {
+		t.Fatalf("expected %s, got %s", dataHash, h)
+	}
+	rc.Close()
+}
+
+func TestExpirySchedulerReload(t *testing.T) { forEachFS(t, testExpirySchedulerReload) }
+
+func testExpirySchedulerReload(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestExpirySchedulerReload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.CreateBucket("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = b.PutTimed(strconv.Itoa(i), strings.NewReader(data), time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = b.PutTimed("short", strings.NewReader(data), 1500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Put("0", strings.NewReader(data)); err != nil { // overwriting without a ttl cancels the expiry
+		t.Fatal(err)
+	}
+	if n := db.expiry.Len(); n != 10 {
+		t.Fatalf("expected 10 scheduled keys, got %d", n)
+	}
+	db.Close(context.Background())
+
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	if n := db.expiry.Len(); n != 10 {
+		t.Fatalf("expected 10 scheduled keys after reloading, got %d", n)
+	}
+
+	b = db.Bucket("a", "b")
+	if _, err = b.Stat("short"); err != nil {
+		t.Fatal("short expired too early")
+	}
+	time.Sleep(2 * time.Second)
+	if _, err = b.Stat("short"); err == nil {
+		t.Fatal("short didn't expire after reloading")
+	}
+	if n := db.expiry.Len(); n != 9 {
+		t.Fatalf("expected 9 scheduled keys, got %d", n)
+	}
+}
+
+func TestTTL(t *testing.T) { forEachFS(t, testTTL) }
+
+func testTTL(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestTTL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.CreateBucket("ttl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c", "slide"} {
+		if err = b.Put(k, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if d, err := b.TTL("a"); err != nil || d != NoTTL {
+		t.Fatalf("expected NoTTL, got %v %v", d, err)
+	}
+	if _, err = b.TTL("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err = b.Expire("missing", time.Hour); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if err = b.Expire("a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.ExpireAt("b", time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Expire("c", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Persist("c"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.ExpireSliding("slide", 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	b = db.Bucket("ttl")
+
+	if d, _ := b.TTL("a"); d <= 59*time.Minute || d > time.Hour {
+		t.Fatalf("unexpected ttl for a: %v", d)
+	}
+	if d, _ := b.TTL("b"); d <= 119*time.Minute || d > 2*time.Hour {
+		t.Fatalf("unexpected ttl for b: %v", d)
+	}
+	if d, _ := b.TTL("c"); d != NoTTL {
+		t.Fatalf("persisted key has a ttl: %v", d)
+	}
+
+	// keep reading slide past its original expiry
+	for i := 0; i < 4; i++ {
+		time.Sleep(time.Second)
+		rc, err := b.Get("slide")
+		if err != nil {
+			t.Fatalf("sliding key expired while in use (%d): %v", i, err)
+		}
+		rc.Close()
+	}
+	if d, _ := b.TTL("slide"); d <= 0 || d > 2*time.Second {
+		t.Fatalf("unexpected ttl for slide: %v", d)
+	}
+	time.Sleep(3 * time.Second)
+	if _, err = b.Stat("slide"); err == nil {
+		t.Fatal("sliding key didn't expire once it stopped being read")
+	}
+
+	if err = b.ExpireAt("a", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err = b.Stat("a"); err == nil {
+		t.Fatal("ExpireAt in the past didn't expire the key")
+	}
+}
+
+func TestArchiveRenameBack(t *testing.T) { forEachFS(t, testArchiveRenameBack) }
+
+func testArchiveRenameBack(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestArchiveRenameBack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := db.CreateBucket("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := db.CreateBucket("archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, ab := src.(*bucket), archive.(*bucket)
+	path, nPath := b.filePath(db.keyFileName("k")), ab.filePath(db.keyFileName("k"))
+
+	// archiving k from src while renaming it from archive back to src takes the same locks in the opposite direction,
+	// holding the lock of k in src makes sure archiving is waiting for it while the rename starts.
+	for i := 0; i < 5; i++ {
+		if err = b.Put("k", strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err = ab.Put("k", strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err = b.lockWrite(); err != nil {
+			t.Fatal(err)
+		}
+		b.meta.SetExpiryDate("k", time.Now().Unix()-1)
+		b.unlockWrite()
+
+		l := db.lk.Lock(path)
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			b.archiveExpired("k", path, ab, nPath)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		go func() {
+			defer wg.Done()
+			ab.Rename("k", b, "k")
+		}()
+		time.Sleep(10 * time.Millisecond)
+		l.Unlock()
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("archiving and renaming back deadlocked after %d tries", i) // leaks the db, Close would hang too
+		}
+	}
+	db.Close(context.Background())
+}
+
+func TestExpiryPolicy(t *testing.T) { forEachFS(t, testExpiryPolicy) }
+
+func testExpiryPolicy(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestExpiryPolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.CreateBucket("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mux   sync.Mutex
+		calls = map[string]int{}
+		seen  = map[string]string{}
+	)
+	onExpire := func(key string, extra map[string]string, r io.Reader) error {
+		mux.Lock()
+		defer mux.Unlock()
+		if calls[key]++; key == "flaky" && calls[key] == 1 {
+			return errors.New("try again")
+		}
+		seen[key] = hashString(r) + extra["x"]
+		return nil
+	}
+
+	if err = b.SetExpiryPolicy(ExpiryPolicy{Archive: []string{"src"}}); !errors.Is(err, ErrSamePath) {
+		t.Fatalf("expected ErrSamePath, got %v", err)
+	}
+	if err = b.SetExpiryPolicy(ExpiryPolicy{OnExpire: onExpire, Archive: []string{"archive", "src"}, RetryAfter: 2 * time.Second}); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "flaky"} {
+		if err = b.PutTimed(k, strings.NewReader(data), time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if err = b.SetExtraData(k, "x", k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	mux.Lock()
+	if seen["a"] != dataHash+"a" {
+		t.Fatalf("OnExpire wasn't called with the right arguments: %q", seen["a"])
+	}
+	if _, ok := seen["flaky"]; ok || calls["flaky"] != 1 {
+		t.Fatalf("unexpected flaky state: %v %v", seen, calls)
+	}
+	mux.Unlock()
+
+	if _, err = b.Stat("flaky"); err != nil {
+		t.Fatal("a failed OnExpire should keep the key")
+	}
+	time.Sleep(2 * time.Second)
+	if _, err = b.Stat("flaky"); err == nil {
+		t.Fatal("flaky wasn't retried")
+	}
+
+	ab := db.Bucket("archive", "src")
+	for _, k := range []string{"a", "flaky"} {
+		if _, err = b.Stat(k); err == nil {
+			t.Fatalf("%s is still in the source bucket", k)
+		}
+		rc, err := ab.Get(k)
+		if err != nil {
+			t.Fatalf("%s wasn't archived: %v", k, err)
+		}
+		if h := hashString(rc); h != dataHash {
+			t.Fatalf("bad archived value for %s", k)
+		}
+		rc.Close()
+		if ab.GetExtraData(k, "x") != k {
+			t.Fatalf("%s lost its extra data", k)
+		}
+		if d, _ := ab.TTL(k); d != NoTTL {
+			t.Fatalf("%s kept its expiry: %v", k, d)
+		}
+	}
+
+	// the archive is stored, keys that expire while the db is closed still get archived
+	if err = b.PutTimed("offline", strings.NewReader(data), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+	time.Sleep(1500 * time.Millisecond)
+
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	if p := db.Bucket("src").ExpiryPolicy(); len(p.Archive) != 2 || p.OnExpire != nil {
+		t.Fatalf("unexpected policy after reload: %+v", p)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err = db.Bucket("archive", "src").Stat("offline"); err != nil {
+		t.Fatalf("offline wasn't archived: %v", err)
+	}
+	if _, err = db.Bucket("src").Stat("offline"); err == nil {
+		t.Fatal("offline is still in the source bucket")
+	}
+}
+
+func TestBucketTTL(t *testing.T) { forEachFS(t, testBucketTTL) }
+
+func testBucketTTL(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestBucketTTL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Bucket().ExpireBucket(time.Hour); !errors.Is(err, ErrRootBucket) {
+		t.Fatalf("expected ErrRootBucket, got %v", err)
+	}
+
+	b, err := db.CreateBucket("scratch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.SetDefaultTTL(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Put("put", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Append("append", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.PutTimed("timed", strings.NewReader(data), 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.PutTimed("forever", strings.NewReader(data), NoTTL); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Update(func(tx *Tx) error {
+		return tx.Bucket("scratch").Put("tx", strings.NewReader(data))
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.CreateBucket("child"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.ExpireBucket(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	b = db.Bucket("scratch")
+	if d := b.DefaultTTL(); d != time.Hour {
+		t.Fatalf("default ttl didn't survive reloading: %v", d)
+	}
+	if d := b.BucketTTL(); d <= 0 || d > 2*time.Second {
+		t.Fatalf("unexpected bucket ttl: %v", d)
+	}
+	for k, exp := range map[string]time.Duration{"put": time.Hour, "append": time.Hour, "tx": time.Hour, "timed": 2 * time.Hour} {
+		if d, _ := b.TTL(k); d <= exp-time.Minute || d > exp {
+			t.Fatalf("unexpected ttl for %s: %v", k, d)
+		}
+	}
+	if d, _ := b.TTL("forever"); d != NoTTL {
+		t.Fatalf("NoTTL didn't override the default ttl: %v", d)
+	}
+
+	time.Sleep(3 * time.Second)
+	if db.Bucket("scratch") != nil {
+		t.Fatal("the bucket didn't expire")
+	}
+	if _, err = fsys.Stat(b.Path()); !os.IsNotExist(err) {
+		t.Fatalf("the bucket directory still exists: %v", err)
+	}
+	if n := db.expiry.Len(); n != 0 {
+		t.Fatalf("expected nothing to be scheduled after deleting the bucket, got %d", n)
+	}
+}
+
+func TestKeyList(t *testing.T) {
+	var (
+		k    = newKeyList(0)
+		want = map[string]bool{}
+		rnd  = uint64(1)
+	)
+	next := func(n int) int {
+		rnd = rnd*6364136223846793005 + 1442695040888963407
+		return int(rnd>>33) % n
+	}
+	check := func() {
+		t.Helper()
+		exp := make([]string, 0, len(want))
+		for key := range want {
+			exp = append(exp, key)
+		}
+		sort.Strings(exp)
+		if got := k.Names(false); !reflect.DeepEqual(got, exp) {
+			t.Fatalf("expected %v, got %v", exp, got)
+		}
+		rev := make([]string, len(exp))
+		for i, key := range exp {
+			rev[len(rev)-1-i] = key
+		}
+		if got := k.Names(true); !reflect.DeepEqual(got, rev) {
+			t.Fatalf("expected %v, got %v", rev, got)
+		}
+		for _, prefix := range []string{"", "1", "2", "9"} {
+			var exp []string
+			for _, key := range rev {
+				if strings.HasPrefix(key, prefix) {
+					exp = append(exp, key)
+				}
+			}
+			if got := k.page(prefix, "", true, -1); !reflect.DeepEqual(got, exp) {
+				t.Fatalf("%q: expected %v, got %v", prefix, exp, got)
+			}
+		}
+	}
+
+	for i := 0; i < 5000; i++ {
+		key := strconv.Itoa(next(300))
+		if next(3) == 0 {
+			k.Delete(key)
+			delete(want, key)
+		} else {
+			k.Set(key, nil)
+			want[key] = true
+		}
+		if i%250 == 0 {
+			check()
+		}
+	}
+	check()
+
+	m := map[string]os.FileInfo{}
+	for key := range want {
+		m[key] = nil
+	}
+	k = loadKeyList(m)
+	check()
+	for key := range want {
+		k.Delete(key)
+		delete(want, key)
+	}
+	check()
+}
+
+func TestCursor(t *testing.T) { forEachFS(t, testCursor) }
+
+func testCursor(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestCursor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	b, err := db.CreateBucket("cursor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// inserted out of order on purpose
+	for _, k := range []string{"b-2", "a-1", "c-1", "b-1", "a-3", "b-3", "a-2"} {
+		if err = b.Put(k, strings.NewReader(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = b.Delete("a-3"); err != nil {
+		t.Fatal(err)
+	}
+
+	all := func(c *Cursor) string { return strings.Join(c.Page(0), ",") }
+	rev := func(c *Cursor) (out []string) {
+		for k, ok := c.Last(); ok; k, ok = c.Prev() {
+			out = append(out, k)
+		}
+		return
+	}
+
+	if s := strings.Join(b.Keys(false), ","); s != "a-1,a-2,b-1,b-2,b-3,c-1" {
+		t.Fatalf("unexpected keys: %s", s)
+	}
+	if s := strings.Join(b.Keys(true), ","); s != "c-1,b-3,b-2,b-1,a-2,a-1" {
+		t.Fatalf("unexpected reverse keys: %s", s)
+	}
+	if s := all(b.Cursor(nil)); s != "a-1,a-2,b-1,b-2,b-3,c-1" {
+		t.Fatalf("unexpected cursor keys: %s", s)
+	}
+	if s := all(b.Cursor(&CursorOptions{Prefix: "b-"})); s != "b-1,b-2,b-3" {
+		t.Fatalf("unexpected prefix keys: %s", s)
+	}
+	if s := strings.Join(rev(b.Cursor(&CursorOptions{Prefix: "b-"})), ","); s != "b-3,b-2,b-1" {
+		t.Fatalf("unexpected reverse prefix keys: %s", s)
+	}
+	if s := all(b.Cursor(&CursorOptions{Start: "a-2", End: "b-3"})); s != "a-2,b-1,b-2" {
+		t.Fatalf("unexpected range keys: %s", s)
+	}
+	if s := strings.Join(rev(b.Cursor(&CursorOptions{Start: "a-2", End: "b-3"})), ","); s != "b-2,b-1,a-2" {
+		t.Fatalf("unexpected reverse range keys: %s", s)
+	}
+	if s := all(b.Cursor(&CursorOptions{Prefix: "d"})); s != "" {
+		t.Fatalf("unexpected keys for a missing prefix: %s", s)
+	}
+
+	c := b.Cursor(&CursorOptions{Limit: 2})
+	if k, ok := c.Seek("b"); !ok || k != "b-1" {
+		t.Fatalf("unexpected seek result: %q %v", k, ok)
+	}
+	if s := strings.Join(c.Page(5), ","); s != "b-2" {
+		t.Fatalf("limit wasn't respected: %s", s)
+	}
+	if k, ok := c.Seek("b-2"); !ok || k != "b-2" {
+		t.Fatalf("unexpected seek result: %q %v", k, ok)
+	}
+	if k, ok := c.Prev(); !ok || k != "b-1" {
+		t.Fatalf("unexpected prev result: %q %v", k, ok)
+	}
+	rc, err := c.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := readString(rc); s != "b-1" {
+		t.Fatalf("unexpected value: %q", s)
+	}
+	rc.Close()
+
+	// keys added ahead of the cursor show up, keys removed ahead of it don't
+	c = b.Cursor(nil)
+	c.Seek("b-1")
+	if err = b.Put("b-15", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Delete("b-2"); err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Join(c.Page(0), ","); s != "b-15,b-3,c-1" {
+		t.Fatalf("unexpected keys after modifying the bucket: %s", s)
+	}
+}
+
+func TestList(t *testing.T) { forEachFS(t, testList) }
+
+func testList(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestList")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	b, err := db.CreateBucket("list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err = b.Put(fmt.Sprintf("k%02d", i), strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, n := range []string{"k045", "b1", "z"} {
+		if _, err = b.CreateBucket(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listAll := func(opts ListOptions, between func()) (out []string) {
+		for {
+			page, err := b.List(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.Limit > 0 && len(page.Entries) > opts.Limit {
+				t.Fatalf("page too big: %d", len(page.Entries))
+			}
+			for _, e := range page.Entries {
+				n := e.Name
+				if e.Bucket {
+					n += "/"
+				}
+				if opts.IncludeStat && (e.Stat == nil || e.Stat.IsDir() != e.Bucket) {
+					t.Fatalf("bad stat for %s: %v", n, e.Stat)
+				}
+				out = append(out, n)
+			}
+			if page.NextToken == "" {
+				return
+			}
+			if between != nil {
+				between()
+			}
+			opts.Token = page.NextToken
+		}
+	}
+
+	exp := "b1/,k00,k01,k02,k03,k04,k045/,k05,k06,k07,k08,k09,z/"
+	if s := strings.Join(listAll(ListOptions{}, nil), ","); s != exp {
+		t.Fatalf("unexpected listing:\n%s\n%s", s, exp)
+	}
+	if s := strings.Join(listAll(ListOptions{Limit: 3, IncludeStat: true}, nil), ","); s != exp {
+		t.Fatalf("unexpected paged listing:\n%s\n%s", s, exp)
+	}
+	if s := strings.Join(listAll(ListOptions{Limit: 4, Reverse: true}, nil), ","); s != "z/,k09,k08,k07,k06,k05,k045/,k04,k03,k02,k01,k00,b1/" {
+		t.Fatalf("unexpected reverse listing: %s", s)
+	}
+	if s := strings.Join(listAll(ListOptions{Limit: 2, Prefix: "k04"}, nil), ","); s != "k04,k045/" {
+		t.Fatalf("unexpected prefix listing: %s", s)
+	}
+	if s := strings.Join(listAll(ListOptions{Limit: 2, Prefix: "k0", StartAfter: "k07", Reverse: true}, nil), ","); s != "k06,k05,k045/,k04,k03,k02,k01,k00" {
+		t.Fatalf("unexpected reverse prefix listing: %s", s)
+	}
+
+	// tokens stay valid while the bucket changes
+	i := 0
+	s := strings.Join(listAll(ListOptions{Limit: 3}, func() {
+		switch i++; i {
+		case 1:
+			b.Delete("k02") // already listed
+			b.Delete("k03") // not listed yet
+		case 2:
+			b.Put("k08a", strings.NewReader(data))
+			b.Put("a", strings.NewReader(data)) // before the token
+		}
+	}), ",")
+	if s != "b1/,k00,k01,k04,k045/,k05,k06,k07,k08,k08a,k09,z/" {
+		t.Fatalf("unexpected listing while modifying the bucket: %s", s)
+	}
+
+	page, err := b.List(ListOptions{Limit: 2, Prefix: "k"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.List(ListOptions{Limit: 2, Token: page.NextToken}); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected ErrInvalidToken for a different prefix, got %v", err)
+	}
+	if _, err = b.List(ListOptions{Token: "!!"}); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+}
+
+func TestLazyLoad(t *testing.T) { forEachFS(t, testLazyLoad) }
+
+func testLazyLoad(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestLazyLoad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		b, err := db.CreateBucket("p", strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 10; j++ {
+			if err = b.Put(strconv.Itoa(j), strings.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = b.SetExtraData("0", "i", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Bucket("p", "9").PutTimed("short", strings.NewReader(data), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	shortPath := filepath.Join(db.Bucket("p", "9").Path(), db.encodeKey("short"))
+	if _, err = fsys.Stat(shortPath); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+
+	if db, err = New(tmpDir, &Options{FS: fsys, LazyLoad: true, MaxResidentBuckets: 3}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	// the expiry index loads the buckets nobody opened once they have something to expire, and only those
+	time.Sleep(2 * time.Second)
+	if _, err = fsys.Stat(shortPath); !os.IsNotExist(err) {
+		t.Fatalf("short didn't expire: %v", err)
+	}
+	if n := db.resident.Len(); n != 1 {
+		t.Fatalf("expected only the bucket with an expiry to be loaded, got %d", n)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := db.Bucket("p", strconv.Itoa(i))
+			for n := 0; n < 5; n++ {
+				if keys := b.Keys(false); len(keys) != 10 {
+					t.Errorf("%d: expected 10 keys, got %v", i, keys)
+					return
+				}
+				if v := b.GetExtraData("0", "i"); v != strconv.Itoa(i) {
+					t.Errorf("%d: unexpected extra data %q", i, v)
+					return
+				}
+				if err := b.Put("new", strings.NewReader(data)); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := b.Delete("new"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// buckets that were in use when they should have been unloaded are unloaded by the next access
+	if id := db.Bucket("p", "0").NextID().Int64(); id != 15 {
+		t.Fatalf("the counter got lost while unloading: %d", id)
+	}
+	if n := db.resident.Len(); n > 3 {
+		t.Fatalf("expected at most 3 resident buckets, got %d", n)
+	}
+}
+
+func TestExpiryIndex(t *testing.T) { forEachFS(t, testExpiryIndex) }
+
+func testExpiryIndex(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestExpiryIndex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	opts := &Options{FS: fsys, LazyLoad: true, MaxResidentBuckets: 10}
+	putShort := func() string {
+		db, err := New(tmpDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close(context.Background())
+		for i := 0; i < 5; i++ {
+			if err = db.Bucket("a", strconv.Itoa(i)).Put("k", strings.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		b := db.Bucket("a", "3")
+		if err = b.PutTimed("short", strings.NewReader(data), time.Second); err != nil {
+			t.Fatal(err)
+		}
+		return filepath.Join(b.Path(), db.encodeKey("short"))
+	}
+	waitExpired := func(path string) {
+		db, err := New(tmpDir, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close(context.Background())
+		time.Sleep(2 * time.Second)
+		if _, err = fsys.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("short didn't expire: %v", err)
+		}
+		if n := db.resident.Len(); n != 1 {
+			t.Fatalf("expected only the bucket with an expiry to be loaded, got %d", n)
+		}
+	}
+
+	// the first New walks the whole tree, the expiry index is complete once it's done
+	db, err := New(tmpDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateBucket("a"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err = db.CreateBucket("a", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.bg.Wait()
+	if _, ok := db.expiries.entries(); !ok {
+		t.Fatal("expected the index to be complete")
+	}
+	db.Close(context.Background())
+
+	waitExpired(putShort())
+
+	// without an index, the walk finds it
+	path := putShort()
+	if err = fsys.Remove(filepath.Join(tmpDir, expiryIndexName)); err != nil {
+		t.Fatal(err)
+	}
+	db, err = New(tmpDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * time.Second)
+	if _, err = fsys.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("short didn't expire: %v", err)
+	}
+	db.Close(context.Background())
+	if _, err = fsys.Stat(filepath.Join(tmpDir, expiryIndexName)); err != nil {
+		t.Fatalf("expected the walk to store the index: %v", err)
+	}
+
+	waitExpired(putShort())
+}
+
+func TestExpiryLockOrder(t *testing.T) { forEachFS(t, testExpiryLockOrder) }
+
+func testExpiryLockOrder(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestExpiryLockOrder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	b, err := db.CreateBucket("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// OnExpire makes the scheduler go through removeExpired, which takes the path lock
+	onExpire := func(key string, extra map[string]string, r io.Reader) error { return nil }
+	if err = b.SetExpiryPolicy(ExpiryPolicy{OnExpire: onExpire}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 100; j++ {
+					k := strconv.Itoa(j % 5)
+					b.Put(k, strings.NewReader(data))
+					b.ExpireAt(k, time.Now().Add(-time.Second))
+					if i%2 == 0 {
+						b.Delete(k)
+					} else {
+						b.Rename(k, b, k+"-moved")
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("deadlocked")
+	}
+}
+
+func TestResidentExpiryPolicy(t *testing.T) { forEachFS(t, testResidentExpiryPolicy) }
+
+func testResidentExpiryPolicy(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestResidentExpiryPolicy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys, LazyLoad: true, MaxResidentBuckets: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	b, err := db.CreateBucket("policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := make(chan string, 1)
+	onExpire := func(key string, extra map[string]string, r io.Reader) error {
+		called <- key + extra["x"]
+		return nil
+	}
+	if err = b.SetExpiryPolicy(ExpiryPolicy{OnExpire: onExpire}); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.PutTimed("k", strings.NewReader(data), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.SetExtraData("k", "x", "y"); err != nil {
+		t.Fatal(err)
+	}
+
+	// loading another bucket evicts policy, the expiry reloads it
+	o, err := db.CreateBucket("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = o.Put("k", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	pb := b.(*bucket)
+	pb.mux.RLock()
+	unloaded := pb.keys == nil
+	pb.mux.RUnlock()
+	if !unloaded {
+		t.Fatal("expected policy to be unloaded")
+	}
+
+	select {
+	case v := <-called:
+		if v != "ky" {
+			t.Fatalf("unexpected OnExpire call %q", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnExpire wasn't called")
+	}
+
+	var err2 error
+	for i := 0; i < 50; i++ { // OnExpire runs before the key is removed
+		if _, err2 = b.Stat("k"); errors.Is(err2, ErrNotFound) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !errors.Is(err2, ErrNotFound) {
+		t.Fatalf("expected k to be deleted, got %v", err2)
+	}
+	if v := b.GetExtraData("k", "x"); v != "" {
+		t.Fatalf("stale extra data: %q", v)
+	}
+}
+
+func TestShardedLayout(t *testing.T) { forEachFS(t, testShardedLayout) }
+
+func testShardedLayout(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestShardedLayout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.CreateBucket("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if err = b.Put(strconv.Itoa(i), strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = b.CreateBucket("child"); err != nil {
+		t.Fatal(err)
+	}
+	bigPath := b.Path()
+	db.Close(context.Background())
+
+	countTop := func() (n int) {
+		des, err := fsys.ReadDir(bigPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, de := range des {
+			if de.Type().IsRegular() && de.Name()[0] != '.' {
+				n++
+			}
+		}
+		return
+	}
+	check := func(db *DB, n int) {
+		t.Helper()
+		b := db.Bucket("big")
+		if keys := b.Keys(false); len(keys) != n {
+			t.Fatalf("expected %d keys, got %d", n, len(keys))
+		}
+		for _, k := range b.Keys(false) {
+			rc, err := b.Get(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h := hashString(rc); h != dataHash {
+				t.Fatalf("bad value for %s", k)
+			}
+			rc.Close()
+		}
+		if db.Bucket("big", "child") == nil {
+			t.Fatal("lost the child bucket")
+		}
+	}
+
+	// existing buckets keep their layout unless asked to migrate
+	if db, err = New(tmpDir, &Options{FS: fsys, Layout: LayoutSharded}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countTop(); n != 50 {
+		t.Fatalf("expected 50 flat files, got %d", n)
+	}
+	nb, err := db.CreateBucket("new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nb.Put("x", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fsys.Stat(shardPath(nb.Path(), db.encodeKey("x"))); err != nil {
+		t.Fatalf("new buckets should use the sharded layout: %v", err)
+	}
+	db.Close(context.Background())
+
+	if db, err = New(tmpDir, &Options{FS: fsys, Layout: LayoutSharded, MigrateLayout: true}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countTop(); n != 0 {
+		t.Fatalf("expected no flat files after migrating, got %d", n)
+	}
+	check(db, 50)
+	b = db.Bucket("big")
+	if err = b.Put("after", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Rename("0", db.Bucket("new"), "renamed"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Delete("1"); err != nil {
+		t.Fatal(err)
+	}
+	check(db, 49)
+
+	// exports don't depend on the layout
+	var buf bytes.Buffer
+	if err = b.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(hdr.Name, shardsDirName) {
+			t.Fatalf("export leaked the layout: %s", hdr.Name)
+		}
+	}
+	db.Close(context.Background())
+
+	// stays sharded without MigrateLayout, even if Layout says otherwise
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	check(db, 49)
+	if n := countTop(); n != 0 {
+		t.Fatalf("expected no flat files, got %d", n)
+	}
+	db.Close(context.Background())
+
+	if db, err = New(tmpDir, &Options{FS: fsys, MigrateLayout: true}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	check(db, 49)
+	if n := countTop(); n != 49 {
+		t.Fatalf("expected 49 flat files after migrating back, got %d", n)
+	}
+	if _, err = fsys.Stat(filepath.Join(bigPath, shardsDirName)); !os.IsNotExist(err) {
+		t.Fatalf("the shards weren't removed: %v", err)
+	}
+}
+
+func TestLongKeys(t *testing.T) { forEachFS(t, testLongKeys) }
+
+func testLongKeys(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestLongKeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.CreateBucket("long")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, nKey := strings.Repeat("k", 300), strings.Repeat("n", 300)
+	if err = b.Put(key, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Put("short", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	fn := db.keyFileName(key)
+	if !isLongKeyFile(fn) || len(fn) > maxKeyFileName {
+		t.Fatalf("unexpected file name %q", fn)
+	}
+	if _, err = fsys.Stat(filepath.Join(b.Path(), fn)); err != nil {
+		t.Fatal(err)
+	}
+	if keys := b.Keys(false); len(keys) != 2 || keys[0] != key {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	if err = b.Rename(key, b, nKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Get(key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not exist, got %v", err)
+	}
+	if err = b.Rename("short", b, key); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	b = db.Bucket("long")
+	if keys := b.Keys(false); len(keys) != 2 || keys[0] != key || keys[1] != nKey {
+		t.Fatalf("unexpected keys after reopening: %v", keys)
+	}
+	for _, k := range []string{key, nKey} {
+		rc, err := b.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := hashString(rc); h != dataHash {
+			t.Fatalf("bad value for %s", k)
+		}
+		rc.Close()
+	}
+
+	var buf bytes.Buffer
+	if err = b.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		names = append(names, filepath.Base(hdr.Name))
+	}
+	if len(names) != 2 || names[0] != key || names[1] != nKey {
+		t.Fatalf("unexpected export names: %v", names)
+	}
+
+	if err = b.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if keys := b.Keys(false); len(keys) != 1 || keys[0] != nKey {
+		t.Fatalf("unexpected keys after delete: %v", keys)
+	}
+}
+
+func TestKeyEncoders(t *testing.T) {
+	keys := []string{"a", ".", "..", ".hidden", "a/b:c%d", "\x00\xff", "ü~-_.", strings.Repeat("x", 10)}
+	for name, enc := range map[string]KeyEncoder{"base64": Base64Keys, "percent": PercentKeys, "base32": Base32Keys, "hex": HexKeys} {
+		for _, k := range keys {
+			fn := enc.Encode(k)
+			if fn == "" || fn[0] == '.' || strings.ContainsAny(fn, "/\\") {
+				t.Fatalf("%s: bad name for %q: %q", name, k, fn)
+			}
+			if dk, err := enc.Decode(fn); err != nil || dk != k {
+				t.Fatalf("%s: %q -> %q -> %q (%v)", name, k, fn, dk, err)
+			}
+		}
+		if _, err := enc.Decode(metaName); err == nil {
+			t.Fatalf("%s: decoded %s", name, metaName)
+		}
+		if _, err := enc.Decode(longKeyPrefix + "00"); err == nil {
+			t.Fatalf("%s: decoded a long key name", name)
+		}
+	}
+	if fn := PercentKeys.Encode("a/b.c"); fn != "a%2Fb.c" {
+		t.Fatalf("unexpected percent encoding: %q", fn)
+	}
+	if _, err := PercentKeys.Decode("%41"); err == nil {
+		t.Fatal("decoded a non-canonical name")
+	}
+}
+
+func TestReencode(t *testing.T) { forEachFS(t, testReencode) }
+
+func testReencode(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestReencode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	keys := []string{"a", "a/b", ".x", strings.Repeat("y", 180)} // the last one is only short with PercentKeys
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.CreateBucket("some/bucket", "child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range keys {
+		if err = b.Put(k, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = b.SetExtraData("a/b", "x", "y"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+
+	check := func(enc KeyEncoder) {
+		t.Helper()
+		db, err := New(tmpDir, &Options{FS: fsys, KeyEncoder: enc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close(context.Background())
+		b := db.Bucket("some/bucket", "child")
+		if b == nil {
+			t.Fatal("lost the bucket")
+		}
+		if got := b.Keys(false); !sameNames(got, []string{".x", "a", "a/b", keys[3]}) {
+			t.Fatalf("unexpected keys: %v", got)
+		}
+		for _, k := range keys {
+			rc, err := b.Get(k)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h := hashString(rc); h != dataHash {
+				t.Fatalf("bad value for %s", k)
+			}
+			rc.Close()
+			if _, err = fsys.Stat(filepath.Join(b.Path(), db.keyFileName(k))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if v := b.GetExtraData("a/b", "x"); v != "y" {
+			t.Fatalf("lost extra data: %q", v)
+		}
+	}
+
+	from := Base64Keys
+	for _, enc := range []KeyEncoder{PercentKeys, Base32Keys, HexKeys, Base64Keys} {
+		if err = Reencode(tmpDir, from, enc, &Options{FS: fsys}); err != nil {
+			t.Fatal(err)
+		}
+		check(enc)
+		from = enc
+	}
+	if _, err = fsys.Stat(filepath.Join(tmpDir, "some%2Fbucket")); err == nil {
+		t.Fatal("the percent encoded bucket is still there")
+	}
+}
+
+func TestReencodeChecks(t *testing.T) { forEachFS(t, testReencodeChecks) }
+
+func testReencodeChecks(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestReencodeChecks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.CreateBucket("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Put("plain", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.PutTimed("timed", strings.NewReader(data), time.Second); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+	time.Sleep(1500 * time.Millisecond)
+
+	// none of the base64 names are valid hex
+	if err = Reencode(tmpDir, HexKeys, PercentKeys, &Options{FS: fsys}); !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("expected ErrInvalidName, got %v", err)
+	}
+	if _, err = fsys.Stat(filepath.Join(tmpDir, b64EncodeName("b"), b64EncodeName("plain"))); err != nil {
+		t.Fatalf("a failed Reencode moved files: %v", err)
+	}
+
+	// the expired key is moved along with the rest, it's up to the next New to expire it
+	if err = Reencode(tmpDir, Base64Keys, PercentKeys, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fsys.Stat(filepath.Join(tmpDir, "b", "timed")); err != nil {
+		t.Fatalf("Reencode expired a key: %v", err)
+	}
+}
+
+func TestReencodeInterrupted(t *testing.T) { forEachFS(t, testReencodeInterrupted) }
+
+func testReencodeInterrupted(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestReencodeInterrupted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	keys := []string{"a", "a/b", ".x", strings.Repeat("y", 180)}
+
+	// interrupt the n-th rename until there's nothing left to interrupt,
+	// the next Reencode has to finish the job either way.
+	for n := 0; ; n++ {
+		dir := filepath.Join(tmpDir, strconv.Itoa(n))
+		db, err := New(dir, &Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, names := range [][]string{{"some/bucket"}, {"some/bucket", "child"}} {
+			b, err := db.CreateBucket(names...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range keys {
+				if err = b.Put(k, strings.NewReader(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		db.Close(context.Background())
+
+		ifs := &interruptingFS{FS: fsys, renames: int64(n)}
+		done := Reencode(dir, Base64Keys, PercentKeys, &Options{FS: ifs}) == nil
+		if !done {
+			if err = Reencode(dir, Base64Keys, PercentKeys, &Options{FS: fsys}); err != nil {
+				t.Fatalf("%d: %v", n, err)
+			}
+		}
+
+		if db, err = New(dir, &Options{FS: fsys, KeyEncoder: PercentKeys}); err != nil {
+			t.Fatal(err)
+		}
+		for _, names := range [][]string{{"some/bucket"}, {"some/bucket", "child"}} {
+			b := db.Bucket(names...)
+			if b == nil {
+				t.Fatalf("%d: lost %v", n, names)
+			}
+			if got := b.Keys(false); !sameNames(got, []string{".x", "a", "a/b", keys[3]}) {
+				t.Fatalf("%d: unexpected keys in %v: %v", n, names, got)
+			}
+			for _, k := range keys {
+				rc, err := b.Get(k)
+				if err != nil {
+					t.Fatalf("%d: %v", n, err)
+				}
+				if h := hashString(rc); h != dataHash {
+					t.Fatalf("%d: bad value for %s", n, k)
+				}
+				rc.Close()
+			}
+		}
+		db.Close(context.Background())
+		if _, err = fsys.Stat(filepath.Join(dir, reencodeJournalName)); err == nil {
+			t.Fatalf("%d: the journal is still there", n)
+		}
+		if done {
+			if n < 10 {
+				t.Fatalf("only %d renames", n)
+			}
+			return
+		}
+	}
+}
+
+// interruptingFS fails every rename after the first few.
+type interruptingFS struct {
+	FS
+	renames int64
+}
+
+func (fs *interruptingFS) Rename(oldpath, newpath string) error {
+	if atomic.AddInt64(&fs.renames, -1) < 0 {
+		return errInterrupted
+	}
+	return fs.FS.Rename(oldpath, newpath)
+}
+
+const errInterrupted = oerrs.String("interrupted")
+
+func TestInvalidKeys(t *testing.T) { forEachFS(t, testInvalidKeys) }
+
+func testInvalidKeys(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestInvalidKeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	const errReserved = oerrs.String("reserved")
+	db, err := New(tmpDir, &Options{FS: fsys, PlainFileNames: true, KeyValidator: func(key string) error {
+		if key == "admin" {
+			return errReserved
+		}
+		return nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := db.Bucket()
+	if err = b.Put("ok", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var ke *KeyError
+	if err = b.Put("a/b", strings.NewReader(data)); !errors.As(err, &ke) || ke.Char != '/' || !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, k := range []string{"", ".", "..", ".hidden"} {
+		if err = b.Put(k, strings.NewReader(data)); !errors.Is(err, ErrInvalidKey) {
+			t.Fatalf("%q: unexpected error: %v", k, err)
+		}
+	}
+	if _, err = b.Get("a:b"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = b.Rename("ok", b, "a|b"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = b.CreateBucket("x", "a?b"); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = b.Put("admin", strings.NewReader(data)); !errors.Is(err, ErrInvalidKey) || !errors.Is(err, errReserved) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err = b.CreateBucket("admin"); err != nil { // the validator is only for keys
+		t.Fatal(err)
+	}
+
+	if err = db.Update(func(tx *Tx) error {
+		return tx.Bucket().Put("a*b", strings.NewReader(data))
+	}); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if keys := b.Keys(false); len(keys) != 1 || keys[0] != "ok" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	db.Close(context.Background())
+
+	// base64 can store anything, but plain can't
+	tmpDir2 := filepath.Join(tmpDir, "b64")
+	if db, err = New(tmpDir2, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Bucket().Put("a/b", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close(context.Background())
+	if err = Reencode(tmpDir2, Base64Keys, PlainKeys, &Options{FS: fsys}); !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestErrors(t *testing.T) { forEachFS(t, testErrors) }
+
+func testErrors(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestErrors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys, PlainFileNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	b, err := db.CreateBucket("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var e *Error
+	if _, err = b.Get("missing"); !errors.As(err, &e) || e.Op != "Get" || e.Bucket != "a/b" || e.Key != "missing" {
+		t.Fatalf("unexpected error: %#v", err)
+	}
+	if !errors.Is(err, ErrNotFound) || !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a not found error: %v", err)
+	}
+	if _, err = b.Stat("missing"); !errors.Is(err, ErrNotFound) || !errors.Is(err, ErrFileDoesNotExist) {
+		t.Fatalf("expected a not found error: %v", err)
+	}
+	if _, err = b.Group(compressors.NewGzip(6)).Stat("missing"); !errors.As(err, &e) || e.Op != "Stat" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = db.Bucket().DeleteBucket("missing"); !errors.As(err, &e) || e.Op != "DeleteBucket" || e.Bucket != "" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err = b.Put("x", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Rename("x", b, "y:z"); !errors.As(err, &e) || e.Op != "Rename" || !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = b.PutTimed("x", strings.NewReader(data), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Persist("missing"); !errors.As(err, &e) || e.Op != "Persist" || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	errCallback := errors.New("callback")
+	if err = b.ForEach(func(string, io.Reader) error { return errCallback }); !errors.Is(err, errCallback) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// values written without the middleware can't be read with it
+	rc, err := b.Get("x", compressors.NewGzip(6))
+	if err == nil {
+		rc.Close()
+		t.Fatal("expected an error")
+	}
+	var me *MiddlewareError
+	if !errors.As(err, &me) || !errors.As(err, &e) || e.Op != "Get" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestClose(t *testing.T) { forEachFS(t, testClose) }
+
+func testClose(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestClose")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := db.CreateBucket("close")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Put("x", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	// readers returned by Get are in-flight operations until they're closed, so tests have to close them
+	// before closing the database, see TestExport.
+	rc, err := b.Get("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// so is a write that began before Close
+	release, putDone := make(chan struct{}), make(chan error, 1)
+	go func() {
+		putDone <- b.PutFunc("late", func(w io.Writer) error {
+			<-release
+			_, err := io.WriteString(w, data)
+			return err
+		})
+	}()
+	for n := 0; n < 2; time.Sleep(time.Millisecond) {
+		db.ops.mux.Lock()
+		n = db.ops.n
+		db.ops.mux.Unlock()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = db.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Close to time out waiting for the reader: %v", err)
+	}
+	// nothing got torn down, the write still completes
+	close(release)
+	if err = <-putDone; err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Put("y", strings.NewReader(data)); !errors.Is(err, ErrClosing) {
+		t.Fatalf("expected ErrClosing: %v", err)
+	}
+	if _, err = b.Get("x"); !errors.Is(err, ErrClosing) {
+		t.Fatalf("expected ErrClosing: %v", err)
+	}
+
+	// the open reader still works and Close returns once it's closed
+	if _, err = io.Copy(io.Discard, rc); err != nil {
+		t.Fatal(err)
+	}
+	// and it can be called concurrently
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- db.Close(context.Background()) }()
+	}
+	select {
+	case err = <-done:
+		t.Fatalf("Close returned before the reader was closed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	rc.Close()
+	for i := 0; i < 2; i++ {
+		if err = <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if db, err = New(tmpDir, &Options{FS: fsys}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	if keys := db.Bucket("close").Keys(false); !sameNames(keys, []string{"late", "x"}) {
+		t.Fatalf("unexpected keys after reopening: %v", keys)
+	}
+}
+
+func TestContext(t *testing.T) { forEachFS(t, testContext) }
+
+// cancelReader cancels its context after the first read.
+type cancelReader struct {
+	io.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	defer r.cancel()
+	return r.Reader.Read(p[:1])
+}
+
+func testContext(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestContext")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	b, err := db.CreateBucket("ctx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err = b.Put(k, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a writer holding the key
+	l := db.lk.Lock(b.(*bucket).filePath(db.keyFileName("a")))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	if _, err = b.GetContext(ctx, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the get to time out: %v", err)
+	}
+	cancel()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	if err = b.PutContext(ctx, "a", strings.NewReader("new")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the put to time out: %v", err)
+	}
+	cancel()
+	l.Unlock()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	if err = b.PutContext(ctx, "d", &cancelReader{strings.NewReader(data), cancel}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the put to be cancelled: %v", err)
+	}
+	if _, err = b.Stat("d"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("cancelled put stored the key: %v", err)
+	}
+	des, err := fsys.ReadDir(b.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, de := range des {
+		if ok, _ := isTempFile(de.Name()); ok {
+			t.Fatalf("cancelled put left %s behind", de.Name())
+		}
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	var n int
+	err = b.ForEachContext(ctx, func(key string, value io.Reader) error {
+		n++
+		cancel()
+		_, err := io.Copy(io.Discard, value)
+		return err
+	})
+	if !errors.Is(err, context.Canceled) || n != 1 {
+		t.Fatalf("expected ForEach to stop after the first key: %v (%d)", err, n)
+	}
+
+	if err = db.ExportContext(ctx, io.Discard); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the export to be cancelled: %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	rc, err := b.GetContext(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	cancel()
+	if _, err = io.ReadAll(rc); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected reading to be cancelled: %v", err)
+	}
+
+	// the timed out put didn't touch the value
+	if rc, err = b.Get("a"); err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if h := hashString(rc); h != dataHash {
+		t.Fatalf("expected %s, got %s", dataHash, h)
+	}
+}
+
+func TestExportMetadata(t *testing.T) { forEachFS(t, testExportMetadata) }
+
+func testExportMetadata(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestExportMetadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys, PlainFileNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	b, err := db.CreateBucket("meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"timed", "sliding", "plain"} {
+		if err = b.Put(k, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err = b.ExpireAt("timed", exp); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.ExpireSliding("sliding", 2*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.SetExtraData("plain", "owner", "me"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.SetDefaultTTL(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.SetExpiryPolicy(ExpiryPolicy{Archive: []string{"archive"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.ExpireBucket(3 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateBucket("meta", "empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Bucket().Put("root", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = db.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	db2, err := New(filepath.Join(tmpDir, "2"), &Options{FS: fsys, PlainFileNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close(context.Background())
+	if err = db2.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	nb := db2.Bucket("meta")
+	if nb == nil || db2.Bucket("meta", "empty") == nil || db2.Bucket("archive") == nil {
+		t.Fatalf("lost buckets: %v", db2.Bucket().Buckets(false))
+	}
+	if keys := nb.Keys(false); len(keys) != 3 {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+	if a, b := nb.NextID(), b.NextID(); a.Cmp(b) != 0 {
+		t.Fatalf("expected counter %v, got %v", b, a)
+	}
+	if a, b := db2.Bucket().NextID(), db.Bucket().NextID(); a.Cmp(b) != 0 {
+		t.Fatalf("expected root counter %v, got %v", b, a)
+	}
+	if d, _ := nb.TTL("timed"); d <= 59*time.Minute || d > time.Hour {
+		t.Fatalf("unexpected ttl: %v", d)
+	}
+	if d, _ := nb.TTL("plain"); d != NoTTL {
+		t.Fatalf("the default ttl was applied to an imported key: %v", d)
+	}
+	nbk := nb.(*bucket)
+	if s := time.Duration(nbk.meta.Sliding["sliding"]); s != 2*time.Hour {
+		t.Fatalf("unexpected sliding window: %v", s)
+	}
+	if v := nb.GetExtraData("plain", "owner"); v != "me" {
+		t.Fatalf("unexpected extra data: %q", v)
+	}
+	if d := nb.DefaultTTL(); d != time.Minute {
+		t.Fatalf("unexpected default ttl: %v", d)
+	}
+	if p := nb.ExpiryPolicy(); len(p.Archive) != 1 || p.Archive[0] != "archive" {
+		t.Fatalf("unexpected policy: %+v", p)
+	}
+	if d := nb.BucketTTL(); d <= 2*time.Hour || d > 3*time.Hour {
+		t.Fatalf("unexpected bucket ttl: %v", d)
+	}
+}
+
+func TestExportNames(t *testing.T) { forEachFS(t, testExportNames) }
+
+func testExportNames(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestExportNames")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(filepath.Join(tmpDir, "b64"), &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	b, err := db.CreateBucket("docs", "sub dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"keep", "skip"} {
+		if err = b.Put(k, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = db.Bucket("docs").Put("readme.txt", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Bucket().Put("x/y", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err = db.Export(&buf, "docs/sub dir/skip"); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	if exp := []string{"./", "docs/", "docs/readme.txt", "docs/sub dir/", "docs/sub dir/keep", "x/y"}; strings.Join(names, ",") != strings.Join(exp, ",") {
+		t.Fatalf("expected %q, got %q", exp, names)
+	}
+
+	db2, err := New(filepath.Join(tmpDir, "b64-2"), &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close(context.Background())
+	if err = db2.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if keys := db2.Bucket().Keys(false); len(keys) != 1 || keys[0] != "x/y" {
+		t.Fatalf("unexpected keys: %q", keys)
+	}
+	if keys := db2.Bucket("docs", "sub dir").Keys(false); len(keys) != 1 || keys[0] != "keep" {
+		t.Fatalf("unexpected keys: %q", keys)
+	}
+
+	// names are encoded with the encoding of the target
+	buf.Reset()
+	if err = db.Bucket("docs").Export(&buf, "docs/sub dir"); err != nil {
+		t.Fatal(err)
+	}
+	db3, err := New(filepath.Join(tmpDir, "plain"), &Options{FS: fsys, PlainFileNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db3.Close(context.Background())
+	if err = db3.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fsys.Stat(filepath.Join(tmpDir, "plain", "docs", "readme.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if db3.Bucket("docs", "sub dir") != nil {
+		t.Fatal("excluded bucket got exported")
+	}
+}
+
+func TestExportFile(t *testing.T) { forEachFS(t, testExportFile) }
+
+func testExportFile(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestExportFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(filepath.Join(tmpDir, "db"), &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+	if err = db.Bucket().Put("license", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateBucket("skip"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		ext   string
+		magic []byte
+	}{
+		{"tar", nil},
+		{"tar.gz", []byte{0x1f, 0x8b}},
+		{"snappy", []byte("\xff\x06\x00\x00sNaPpY")},
+		{"flate", nil},
+	} {
+		fn := filepath.Join(tmpDir, "backup."+tc.ext)
+		if err = db.ExportFile(fn, "skip"); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.magic != nil && !bytes.HasPrefix(b, tc.magic) {
+			t.Fatalf("%s: expected the file to start with %q", tc.ext, tc.magic)
+		}
+		if isTar(b) != (tc.ext == "tar") {
+			t.Fatalf("%s: unexpected format", tc.ext)
+		}
+
+		// the suffix doesn't matter on import, except for flate, which has no header
+		bak := filepath.Join(tmpDir, "backup-"+tc.ext+".bak")
+		if err = os.Rename(fn, bak); err != nil {
+			t.Fatal(err)
+		}
+		db2, err := New(filepath.Join(tmpDir, "db-"+tc.ext), &Options{FS: fsys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.ext == "flate" {
+			if err = db2.ImportFile(bak); !errors.Is(err, ErrUnknownArchiveFormat) {
+				t.Fatalf("%s: expected ErrUnknownArchiveFormat, got %v", tc.ext, err)
+			}
+			fn, bak = bak, filepath.Join(tmpDir, "backup.deflate")
+			if err = os.Rename(fn, bak); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err = db2.ImportFile(bak); err != nil {
+			t.Fatalf("%s: %v", tc.ext, err)
+		}
+		rc, err := db2.Bucket().Get("license")
+		if err != nil {
+			t.Fatalf("%s: %v", tc.ext, err)
+		}
+		if h := hashString(rc); h != dataHash {
+			t.Fatalf("%s: expected %s, got %s", tc.ext, dataHash, h)
+		}
+		rc.Close()
+		if db2.Bucket("skip") != nil {
+			t.Fatalf("%s: excluded bucket got exported", tc.ext)
+		}
+		db2.Close(context.Background())
+	}
+
+	fn := filepath.Join(tmpDir, "garbage.bak")
+	if err = os.WriteFile(fn, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.ImportFile(fn); !errors.Is(err, ErrUnknownArchiveFormat) {
+		t.Fatalf("expected ErrUnknownArchiveFormat, got %v", err)
+	}
+}
+
+func TestExportSnapshot(t *testing.T) { forEachFS(t, testExportSnapshot) }
+
+func testExportSnapshot(t *testing.T, fsys FS) {
+	// struct{ FS } hides Link, so the snapshot has to copy the files
+	for name, fsys := range map[string]FS{"link": fsys, "copy": struct{ FS }{fsys}} {
+		t.Run(name, func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "iodb-TestExportSnapshot")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !keepTmp {
+				defer os.RemoveAll(tmpDir)
+			}
+			db, err := New(tmpDir, &Options{FS: fsys})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close(context.Background())
+
+			b, err := db.CreateBucket("snap")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cb, err := b.CreateBucket("child")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range []string{"put", "deleted", "appended", "renamed"} {
+				if err = b.Put(k, strings.NewReader(k)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err = cb.Put("gone", strings.NewReader("gone")); err != nil {
+				t.Fatal(err)
+			}
+
+			pr, pw := io.Pipe()
+			go func() { pw.CloseWithError(db.Export(pw)) }()
+			tr := tar.NewReader(pr)
+			if _, err = tr.Next(); err != nil { // the export is captured and blocked on the pipe
+				t.Fatal(err)
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				var el oerrs.ErrorList
+				el.PushIf(b.Put("put", strings.NewReader("new value")))
+				el.PushIf(b.Delete("deleted"))
+				el.PushIf(b.Append("appended", strings.NewReader(" and more")))
+				el.PushIf(b.Rename("renamed", b, "moved"))
+				el.PushIf(b.Put("new", strings.NewReader("new")))
+				el.PushIf(b.DeleteBucket("child"))
+				done <- el.Err()
+			}()
+			select {
+			case err = <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("writes blocked by the export")
+			}
+
+			got := map[string]string{}
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hdr.Typeflag == tar.TypeDir {
+					continue
+				}
+				v, err := io.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got[hdr.Name] = string(v)
+			}
+			exp := map[string]string{
+				"snap/put": "put", "snap/deleted": "deleted", "snap/appended": "appended", "snap/renamed": "renamed",
+				"snap/child/gone": "gone",
+			}
+			if !reflect.DeepEqual(got, exp) {
+				t.Fatalf("expected %v, got %v", exp, got)
+			}
+
+			db.snaps.mux.Lock()
+			n := len(db.snaps.pins)
+			db.snaps.mux.Unlock()
+			if n != 0 {
+				t.Fatalf("%d files still pinned", n)
+			}
+			if des, _ := fsys.ReadDir(filepath.Join(tmpDir, snapshotDirName)); len(des) != 0 {
+				t.Fatalf("snapshot files left behind: %v", des)
+			}
+		})
+	}
+}
+
+func TestExportPointInTime(t *testing.T) { forEachFS(t, testExportPointInTime) }
+
+func testExportPointInTime(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestExportPointInTime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	bkts := make([]Bucket, 8)
+	for i := range bkts {
+		if bkts[i], err = db.CreateBucket(strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = bkts[0].Put("k", strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// k keeps moving between buckets, an export must always have it exactly once
+	stop, done := make(chan struct{}), make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			if err := bkts[i%len(bkts)].Rename("k", bkts[(i+1)%len(bkts)], "k"); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		var buf bytes.Buffer
+		if err = db.Export(&buf); err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		tr := tar.NewReader(&buf)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasSuffix(hdr.Name, "/k") {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Fatalf("export %d has k %d times", i, n)
+		}
+	}
+}
+
+func TestExportMissingFile(t *testing.T) { forEachFS(t, testExportMissingFile) }
+
+func testExportMissingFile(t *testing.T, fsys FS) {
+	tmpDir, err := os.MkdirTemp("", "iodb-TestExportMissingFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(tmpDir, &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	b := db.Bucket()
+	for _, k := range []string{"a", "b"} {
+		if err = b.Put(k, strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// removed behind the database's back once the export is captured
+	path := filepath.Join(b.Path(), db.keyFileName("b"))
+	w := writerFunc(func(p []byte) (int, error) {
+		fsys.Remove(path)
+		return len(p), nil
+	})
+	if err = db.Export(w); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a not exist error, got %v", err)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (fn writerFunc) Write(p []byte) (int, error) { return fn(p) }
+
+func TestExportIncremental(t *testing.T) { forEachFS(t, testExportIncremental) }
+
+func testExportIncremental(t *testing.T, fsys FS) {
+	ctx := context.Background()
+	tmpDir, err := os.MkdirTemp("", "iodb-TestExportIncremental")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keepTmp {
+		defer os.RemoveAll(tmpDir)
+	}
+	db, err := New(filepath.Join(tmpDir, "src"), &Options{FS: fsys, ChangeRetention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close(context.Background())
+
+	a, err := db.CreateBucket("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"put", "deleted", "renamed", "extra", "same"} {
+		if err = a.Put(k, strings.NewReader(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = db.CreateBucket("a", "child"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Bucket("a", "child").Put("same", strings.NewReader("same")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.CreateBucket("gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.Bucket("gone").Put("x", strings.NewReader("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	var full bytes.Buffer
+	m, err := db.ExportWithOptions(ctx, &full, ExportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rm, err := ReadManifest(bytes.NewReader(full.Bytes())); err != nil || !reflect.DeepEqual(rm.Root, m.Root) {
+		t.Fatalf("unexpected manifest %+v (%v), expected %+v", rm, err, m)
+	}
+
+	var el oerrs.ErrorList
+	el.PushIf(a.Put("put", strings.NewReader("new value")))
+	el.PushIf(a.Delete("deleted"))
+	el.PushIf(a.Rename("renamed", a, "moved"))
+	el.PushIf(a.SetExtraData("extra", "owner", "me"))
+	el.PushIf(db.Bucket().DeleteBucket("gone"))
+	if _, err = db.CreateBucket("new"); err != nil {
+		t.Fatal(err)
+	}
+	el.PushIf(db.Bucket("new").Put("y", strings.NewReader("y")))
+	if err = el.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// the tombstone of a deleted key is stored right away, not just when the database closes
+	var am metadata
+	if err = readJSONFile(fsys, filepath.Join(a.Path(), metaName), &am); err != nil || am.Changed["deleted"] == 0 {
+		t.Fatalf("the tombstone of deleted wasn't stored: %v %v", am.Changed, err)
+	}
+
+	exp := map[string]string{
+		"a/put": "new value", "a/moved": "renamed", "a/extra": "extra", "new/y": "y",
+		"a/deleted": "deleted!", "a/renamed": "deleted!", "gone/": "deleted!",
+	}
+	for name, opts := range map[string]ExportOptions{"base": {Base: m}, "since": {Since: m.Time}} {
+		t.Run(name, func(t *testing.T) {
+			var incr bytes.Buffer
+			if _, err := db.ExportWithOptions(ctx, &incr, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]string{}
+			tr := tar.NewReader(bytes.NewReader(incr.Bytes()))
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, ok := hdr.PAXRecords[paxDeleted]; ok {
+					got[hdr.Name] = "deleted!"
+					continue
+				}
+				if hdr.Typeflag == tar.TypeDir || hdr.PAXRecords[paxManifest] != "" {
+					continue
+				}
+				v, _ := io.ReadAll(tr)
+				got[hdr.Name] = string(v)
+			}
+			if !reflect.DeepEqual(got, exp) {
+				t.Fatalf("expected %v, got %v", exp, got)
+			}
+
+			db2, err := New(filepath.Join(tmpDir, "dst-"+name), &Options{FS: fsys})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db2.Close(context.Background())
+			if err = db2.Import(bytes.NewReader(full.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			if err = db2.Import(bytes.NewReader(incr.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			if db2.Bucket("gone") != nil {
+				t.Fatal("the deleted bucket got restored")
+			}
+			if v := db2.Bucket("a").GetExtraData("extra", "owner"); v != "me" {
+				t.Fatalf("expected the extra data to be restored, got %q", v)
+			}
+			for _, p := range [][]string{{"a"}, {"a", "child"}, {"new"}} {
+				if k1, k2 := db.Bucket(p...).Keys(false), db2.Bucket(p...).Keys(false); !reflect.DeepEqual(k1, k2) {
+					t.Fatalf("%v: expected %v, got %v", p, k1, k2)
+				}
+			}
+		})
+	}
+
+	db3, err := New(filepath.Join(tmpDir, "untracked"), &Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db3.Close(context.Background())
+	if _, err = db3.ExportWithOptions(ctx, io.Discard, ExportOptions{Since: time.Now().Add(-time.Minute)}); !errors.Is(err, ErrSinceTooOld) {
+		t.Fatalf("expected ErrSinceTooOld, got %v", err)
+	}
+}
+
+func TestMemFSWrite(t *testing.T) {
+	fsys := NewMemFS()
+	f, err := fsys.OpenFile("/f", os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := []byte(data[:100])
+	// the file grows like a bytes.Buffer instead of getting copied on every write
+	if n := testing.AllocsPerRun(1, func() {
+		for i := 0; i < 1000; i++ {
+			if _, err := f.Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}); n > 50 {
+		t.Fatalf("expected the writes to share allocations, got %v", n)
+	}
+	f.Close()
+
+	b, err := readFile(fsys, "/f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, bytes.Repeat(chunk, 2000)) { // AllocsPerRun runs it once more to warm up
+		t.Fatalf("unexpected contents, %d bytes", len(b))
+	}
+}
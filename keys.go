@@ -0,0 +1,112 @@
+package iodb
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// keyList is the key index of a bucket, it keeps the keys sorted as they're added and removed,
+// so listing and iterating doesn't have to sort the whole bucket every time.
+type keyList struct {
+	m     map[string]os.FileInfo
+	order *skiplist
+}
+
+func newKeyList(size int) *keyList {
+	return &keyList{m: make(map[string]os.FileInfo, size), order: newSkiplist()}
+}
+
+// loadKeyList builds the index in one go instead of inserting the keys one by one.
+func loadKeyList(m map[string]os.FileInfo) *keyList {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	k := &keyList{m: m, order: newSkiplist()}
+	k.order.load(names)
+	return k
+}
+
+func (k *keyList) Len() int { return len(k.m) }
+
+func (k *keyList) Get(key string) (fi os.FileInfo, ok bool) {
+	fi, ok = k.m[key]
+	return
+}
+
+func (k *keyList) Set(key string, fi os.FileInfo) {
+	if _, ok := k.m[key]; !ok {
+		k.order.Insert(key)
+	}
+	k.m[key] = fi
+}
+
+func (k *keyList) Delete(key string) {
+	if _, ok := k.m[key]; !ok {
+		return
+	}
+	delete(k.m, key)
+	k.order.Delete(key)
+}
+
+func (k *keyList) Names(rev bool) []string {
+	out := make([]string, 0, k.order.Len())
+	if !rev {
+		for x := k.order.first(); x != nil; x = x.next[0] {
+			out = append(out, x.key)
+		}
+		return out
+	}
+	for x := k.order.last(); x != nil; x = x.prev {
+		out = append(out, x.key)
+	}
+	return out
+}
+
+func (k *keyList) Paths(rev bool) []string {
+	out := make([]string, 0, len(k.m))
+	for _, p := range k.m {
+		out = append(out, p.Name())
+	}
+	if rev {
+		sort.Sort(sort.Reverse(sort.StringSlice(out)))
+	} else {
+		sort.Strings(out)
+	}
+	return out
+}
+
+// page returns up to n keys starting with prefix that come after the after key, in descending order if rev is set.
+// n < 0 returns all of them.
+func (k *keyList) page(prefix, after string, rev bool, n int) (out []string) {
+	full := func() bool { return n >= 0 && len(out) >= n }
+	if !rev {
+		from := prefix
+		if after != "" && after >= prefix {
+			from = after
+		}
+		x := k.order.ceil(from)
+		if x != nil && after != "" && x.key == after {
+			x = x.next[0]
+		}
+		for ; x != nil && !full() && strings.HasPrefix(x.key, prefix); x = x.next[0] {
+			out = append(out, x.key)
+		}
+		return
+	}
+
+	end := prefixEnd(prefix)
+	if after != "" && (end == "" || after < end) {
+		end = after
+	}
+	x := k.order.last()
+	if end != "" {
+		x = k.order.below(end)
+	}
+	for ; x != nil && !full() && strings.HasPrefix(x.key, prefix); x = x.prev {
+		out = append(out, x.key)
+	}
+	return
+}
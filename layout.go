@@ -0,0 +1,148 @@
+package iodb
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+)
+
+// Layout is how a bucket stores its keys on disk.
+type Layout uint8
+
+const (
+	// LayoutFlat stores every key directly in the bucket's directory.
+	LayoutFlat Layout = iota
+	// LayoutSharded fans keys out into .shards/xx/yy/ subdirectories based on a hash of their file name,
+	// which keeps directories small for buckets with millions of keys.
+	LayoutSharded
+)
+
+const shardsDirName = ".shards"
+
+// shardPath returns the path of fn inside the shards of dir.
+func shardPath(dir, fn string) string {
+	h := fnv.New32a()
+	h.Write([]byte(fn))
+	sum := hex.EncodeToString(h.Sum(nil))
+	return filepath.Join(dir, shardsDirName, sum[:2], sum[2:4], fn)
+}
+
+// shardDirs returns the leaf directories of the shards of dir, if there are any.
+func shardDirs(fsys FS, dir string) (out []string, err error) {
+	root := filepath.Join(dir, shardsDirName)
+	l1, err := fsys.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	for _, d1 := range l1 {
+		if !d1.IsDir() {
+			continue
+		}
+		p1 := filepath.Join(root, d1.Name())
+		var l2 []os.DirEntry
+		if l2, err = fsys.ReadDir(p1); err != nil {
+			return
+		}
+		for _, d2 := range l2 {
+			if d2.IsDir() {
+				out = append(out, filepath.Join(p1, d2.Name()))
+			}
+		}
+	}
+	return
+}
+
+// filePath returns where the file named fn lives, the bucket must have been loaded at least once.
+func (b *bucket) filePath(fn string) string {
+	if b.layout == LayoutSharded {
+		return shardPath(b.path, fn)
+	}
+	return filepath.Join(b.path, fn)
+}
+
+// prepareFile returns where the file named fn lives, loading the bucket if it never was, since that's when its
+// layout is known, and creating its shard directory if needed.
+func (b *bucket) prepareFile(fn string) (path string, err error) {
+	if !b.opened.Load() {
+		if err = b.rlock(); err != nil {
+			return
+		}
+		b.mux.RUnlock()
+	}
+	path = b.filePath(fn)
+	if b.layout == LayoutSharded {
+		err = b.mkdirShard(filepath.Dir(path), b.db.fsyncDir)
+	}
+	return
+}
+
+// mkdirShard creates the shard directory dir and calls fsync on the parents of the directories it had to create,
+// they could disappear in a crash along with the files renamed into them otherwise.
+func (b *bucket) mkdirShard(dir string, fsync func(dir string) error) (err error) {
+	var created []string
+	for d := dir; d != b.path; d = filepath.Dir(d) {
+		if _, err = b.db.fs.Stat(d); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return
+		}
+		created = append(created, d)
+	}
+	if len(created) == 0 {
+		return nil
+	}
+	if err = b.db.fs.MkdirAll(dir, 0o755); err != nil {
+		return
+	}
+	for _, d := range created {
+		if err = fsync(filepath.Dir(d)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// listFiles returns the files of the bucket in both layouts, with their paths.
+func (b *bucket) listFiles() (files []os.FileInfo, paths []string, dirs []os.FileInfo, err error) {
+	if files, dirs, err = lsDir(b.db.fs, b.path); err != nil {
+		return
+	}
+	for _, fi := range files {
+		paths = append(paths, filepath.Join(b.path, fi.Name()))
+	}
+
+	var sds []string
+	if sds, err = shardDirs(b.db.fs, b.path); err != nil {
+		return
+	}
+	for _, sd := range sds {
+		var sfiles []os.FileInfo
+		if sfiles, _, err = lsDir(b.db.fs, sd); err != nil {
+			return
+		}
+		for _, fi := range sfiles {
+			files = append(files, fi)
+			paths = append(paths, filepath.Join(sd, fi.Name()))
+		}
+	}
+	return
+}
+
+// moveFile moves a file found in the wrong layout to where it belongs, this is how buckets get migrated,
+// or finish migrating after getting interrupted.
+func (b *bucket) moveFile(src, dst string) error {
+	fsync := func(dir string) error { // not batched, moveFile is called with the bucket lock held
+		if b.db.opts.SyncMode >= SyncFull {
+			return syncDir(b.db.fs, dir)
+		}
+		return nil
+	}
+	if err := b.mkdirShard(filepath.Dir(dst), fsync); err != nil {
+		return err
+	}
+	return b.db.fs.Rename(src, dst)
+}
@@ -0,0 +1,148 @@
+package iodb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ListOptions controls what List returns.
+type ListOptions struct {
+	// Prefix limits the listing to keys and buckets starting with it.
+	Prefix string
+	// StartAfter starts the listing after this name, it's ignored if Token is set.
+	StartAfter string
+	// Limit is the maximum number of entries per page, <= 0 returns everything in one page.
+	Limit int
+	// Reverse lists in descending order.
+	Reverse bool
+	// IncludeStat fills ListEntry.Stat.
+	IncludeStat bool
+	// Token is the NextToken of the previous page.
+	Token string
+}
+
+// ListEntry is a key or a child bucket returned by List.
+type ListEntry struct {
+	Name   string
+	Bucket bool
+	Stat   os.FileInfo // only set with ListOptions.IncludeStat
+}
+
+// ListPage is a page of entries returned by List.
+type ListPage struct {
+	Entries []ListEntry
+	// NextToken is passed as ListOptions.Token to get the next page, it's empty on the last page.
+	NextToken string
+}
+
+// listToken is where a page ended, it's a name rather than an offset so it stays valid while the bucket changes.
+type listToken struct {
+	After   string `json:"a"`
+	Prefix  string `json:"p,omitempty"`
+	Reverse bool   `json:"r,omitempty"`
+}
+
+func (t *listToken) encode() string {
+	j, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(j)
+}
+
+func decodeListToken(s string) (t listToken, err error) {
+	var j []byte
+	if j, err = base64.RawURLEncoding.DecodeString(s); err != nil {
+		return t, ErrInvalidToken
+	}
+	if err = json.Unmarshal(j, &t); err != nil {
+		return t, ErrInvalidToken
+	}
+	return
+}
+
+// List returns a page of the keys and child buckets of the bucket, sorted by name.
+func (b *bucket) List(opts ListOptions) (_ *ListPage, err error) {
+	defer b.wrapErr("List", "", &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	after := opts.StartAfter
+	if opts.Token != "" {
+		var t listToken
+		if t, err = decodeListToken(opts.Token); err != nil {
+			return
+		}
+		if t.Prefix != opts.Prefix || t.Reverse != opts.Reverse {
+			return nil, ErrInvalidToken
+		}
+		after = t.After
+	}
+
+	n := -1
+	if opts.Limit > 0 {
+		n = opts.Limit + 1 // one extra to know if there's a next page
+	}
+
+	if err = b.rlock(); err != nil {
+		return
+	}
+	keys := b.keys.page(opts.Prefix, after, opts.Reverse, n)
+	var bkts []*bucket
+	for name, cb := range b.buckets {
+		if !strings.HasPrefix(name, opts.Prefix) {
+			continue
+		}
+		if after != "" && (!opts.Reverse && name <= after || opts.Reverse && name >= after) {
+			continue
+		}
+		bkts = append(bkts, cb)
+	}
+	sort.Slice(bkts, func(i, j int) bool { return (bkts[i].name < bkts[j].name) != opts.Reverse })
+
+	var (
+		page     = &ListPage{}
+		bktPaths = map[int]string{} // buckets are stat'd after unlocking
+		less     = func(a, b string) bool { return (a < b) != opts.Reverse }
+	)
+	for len(keys) > 0 || len(bkts) > 0 {
+		if n > 0 && len(page.Entries) == n {
+			break
+		}
+		var e ListEntry
+		if len(bkts) == 0 || (len(keys) > 0 && less(keys[0], bkts[0].name)) {
+			e.Name = keys[0]
+			if opts.IncludeStat {
+				e.Stat, _ = b.keys.Get(keys[0])
+			}
+			keys = keys[1:]
+		} else {
+			e.Name, e.Bucket = bkts[0].name, true
+			bktPaths[len(page.Entries)] = bkts[0].path
+			bkts = bkts[1:]
+		}
+		page.Entries = append(page.Entries, e)
+	}
+	b.mux.RUnlock()
+
+	if n > 0 && len(page.Entries) == n {
+		page.Entries = page.Entries[:opts.Limit]
+		t := listToken{After: page.Entries[opts.Limit-1].Name, Prefix: opts.Prefix, Reverse: opts.Reverse}
+		page.NextToken = t.encode()
+	}
+
+	if opts.IncludeStat {
+		for i, path := range bktPaths {
+			if i >= len(page.Entries) {
+				continue
+			}
+			// a bucket deleted since we unlocked just doesn't get a Stat
+			if page.Entries[i].Stat, err = b.db.fs.Stat(path); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+	}
+
+	return page, nil
+}
@@ -1,6 +1,7 @@
 package iodb
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -10,23 +11,31 @@ const cleanupDuration = 10 * time.Minute
 
 func newPathLocker() (pl *pathLocker) {
 	pl = &pathLocker{
-		m: map[string]*rwlock{},
-		t: time.NewTicker(cleanupDuration),
+		m:    map[string]*rwlock{},
+		t:    time.NewTicker(cleanupDuration),
+		done: make(chan struct{}),
 	}
 	go func() {
-		for range pl.t.C {
-			pl.mux.Lock()
-			pl.purge()
-			pl.mux.Unlock()
+		for {
+			select {
+			case <-pl.t.C:
+				pl.mux.Lock()
+				pl.purge()
+				pl.mux.Unlock()
+			case <-pl.done:
+				return
+			}
 		}
 	}()
 	return
 }
 
 type pathLocker struct {
-	m   map[string]*rwlock
-	t   *time.Ticker
-	mux sync.Mutex
+	m    map[string]*rwlock
+	t    *time.Ticker
+	done chan struct{}
+	stop sync.Once
+	mux  sync.Mutex
 }
 
 // get is *only* called internally by Lock(p) / RLock(p)
@@ -53,18 +62,48 @@ func (pl *pathLocker) RLock(p string) (l *rwlock) {
 	return
 }
 
-// Close blocks until all locks are cleared.
-func (pl *pathLocker) Close() error { // provide Closer interface
-	pl.mux.Lock()
-	defer pl.mux.Unlock()
+// LockContext is Lock, but it gives up waiting once ctx is done and returns ctx.Err().
+func (pl *pathLocker) LockContext(ctx context.Context, p string) (l *rwlock, err error) {
+	l, _ = pl.get(p)
+	if err = lockContext(ctx, l.mux.TryLock, l.mux.Lock, l.Unlock); err != nil {
+		return nil, err
+	}
+	return
+}
 
-	pl.t.Stop()
+// RLockContext is RLock, but it gives up waiting once ctx is done and returns ctx.Err().
+func (pl *pathLocker) RLockContext(ctx context.Context, p string) (l *rwlock, err error) {
+	l, _ = pl.get(p)
+	if err = lockContext(ctx, l.mux.TryRLock, l.mux.RLock, l.RUnlock); err != nil {
+		return nil, err
+	}
+	return
+}
 
-	for len(pl.m) > 0 {
-		pl.purge()
-		time.Sleep(time.Millisecond) // don't burn the cpu
+// LockPair locks both paths in sorted order, so two callers moving files between them in opposite directions
+// can't deadlock, unlock releases both.
+func (pl *pathLocker) LockPair(p, np string) (unlock func()) {
+	if np < p {
+		p, np = np, p
 	}
+	l := pl.Lock(p)
+	if p == np {
+		return l.Unlock
+	}
+	nl := pl.Lock(np)
+	return func() {
+		nl.Unlock()
+		l.Unlock()
+	}
+}
 
+// Close stops the cleanup goroutine, DB.Close waits for operations to finish before calling it,
+// so there are no locks left to wait for.
+func (pl *pathLocker) Close() error { // provide Closer interface
+	pl.stop.Do(func() {
+		pl.t.Stop()
+		close(pl.done)
+	})
 	return nil
 }
 
@@ -98,3 +137,29 @@ func (rw *rwlock) RUnlock() {
 func (rw *rwlock) IsActive() bool {
 	return atomic.LoadInt64(&rw.active) != 0
 }
+
+// lockContext calls lock unless ctx is done first, if it gives up the lock is released by unlock as soon as it's acquired.
+func lockContext(ctx context.Context, tryLock func() bool, lock, unlock func()) error {
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+	if tryLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			unlock()
+		}()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,107 @@
+package iodb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	// longKeyPrefix can't clash with encoded keys, % isn't valid in plain file names or any of the other encodings,
+	// except for PercentKeys where it's always followed by two hex digits.
+	longKeyPrefix = "%%"
+	// maxKeyFileName leaves room for the temp file prefix and suffix under the usual 255 bytes limit.
+	maxKeyFileName = 200
+)
+
+// keyFileName returns the name of the file key is stored in,
+// keys with an encoded name that's too long are stored under a hash of the key instead.
+func (db *DB) keyFileName(key string) string {
+	return keyFileName(db.enc, key)
+}
+
+func keyFileName(enc KeyEncoder, key string) string {
+	if fn := enc.Encode(key); len(fn) <= maxKeyFileName {
+		return fn
+	}
+	h := sha256.Sum256([]byte(key))
+	return longKeyPrefix + hex.EncodeToString(h[:])
+}
+
+func isLongKeyFile(fn string) bool {
+	return strings.HasPrefix(fn, longKeyPrefix)
+}
+
+// fileKey returns the key stored in the file named fn, b.mux must be held.
+func (b *bucket) fileKey(fn string) (string, error) {
+	if !isLongKeyFile(fn) {
+		return b.db.decodeKey(fn)
+	}
+	if key, ok := b.meta.LongKeys[fn]; ok {
+		return key, nil
+	}
+	return "", ErrNotFound
+}
+
+// setKey adds key to the index, recording its name if it's a long key, b.mux must be held.
+// it returns true if the metadata needs to be stored.
+func (b *bucket) setKey(key string, fi os.FileInfo) bool {
+	b.keys.Set(key, fi)
+	fn := fi.Name()
+	if !isLongKeyFile(fn) || b.meta.LongKeys[fn] == key {
+		return false
+	}
+	if b.meta.LongKeys == nil {
+		b.meta.LongKeys = map[string]string{}
+	}
+	b.meta.LongKeys[fn] = key
+	return true
+}
+
+// removeKey removes key from the index, b.mux must be held.
+// it returns true if the metadata needs to be stored.
+func (b *bucket) removeKey(key string) bool {
+	fi, ok := b.keys.Get(key)
+	if !ok {
+		return false
+	}
+	b.keys.Delete(key)
+	if fn := fi.Name(); isLongKeyFile(fn) {
+		delete(b.meta.LongKeys, fn)
+		if len(b.meta.LongKeys) == 0 {
+			b.meta.LongKeys = nil
+		}
+		return true
+	}
+	return false
+}
+
+// storeMetaPair stores the metadata of b and nb after a key moved between them, both must be locked.
+func (b *bucket) storeMetaPair(nb *bucket) error {
+	if err := b.meta.store(); err != nil || nb == b {
+		return err
+	}
+	return nb.meta.store()
+}
+
+// quarantineLongKeyFile moves away a long key file that doesn't have its key in the metadata anymore,
+// there's no way to know which key it was.
+func (b *bucket) quarantineLongKeyFile(path string) {
+	log.Printf("iodb: unknown long key file %s", path)
+	if err := b.db.quarantine(path); err != nil {
+		log.Printf("iodb: error quarantining %s: %v", path, err)
+	}
+}
+
+// pruneLongKeys drops long key names that don't have a file anymore, b.mux must be held.
+func (b *bucket) pruneLongKeys() (changed bool) {
+	for fn, key := range b.meta.LongKeys {
+		if fi, ok := b.keys.Get(key); !ok || fi.Name() != fn {
+			delete(b.meta.LongKeys, fn)
+			changed = true
+		}
+	}
+	return
+}
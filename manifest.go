@@ -0,0 +1,153 @@
+package iodb
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"hash/fnv"
+	"io"
+	"sort"
+	"time"
+)
+
+// ExportOptions controls what ExportWithOptions writes, the zero value exports everything.
+type ExportOptions struct {
+	// Exclude are paths of buckets and keys to skip, see Export.
+	Exclude []string
+	// Since only exports the keys that changed after it, with tombstones for the ones deleted since,
+	// it can't be further back than Options.ChangeRetention.
+	Since time.Time
+	// Base only exports the keys that changed since the export it came from, with tombstones for the ones deleted since,
+	// it takes precedence over Since and doesn't need Options.ChangeRetention.
+	Base *Manifest
+}
+
+// Manifest describes everything an export captured, including what an incremental export skipped because it didn't change,
+// so the next incremental export can be based on it.
+type Manifest struct {
+	// Time is when the export started capturing, it can be used as the Since of the next one.
+	Time time.Time       `json:"time"`
+	Root *ManifestBucket `json:"root"`
+}
+
+// ManifestBucket is a bucket in a Manifest, the buckets are relative to the root bucket even if it wasn't exported.
+type ManifestBucket struct {
+	Keys    map[string]ManifestKey     `json:"keys,omitempty"`
+	Buckets map[string]*ManifestBucket `json:"buckets,omitempty"`
+}
+
+// ManifestKey is a key in a Manifest, a key changed if any of them did.
+type ManifestKey struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"` // unix nanoseconds
+	Meta    uint64 `json:"meta"`    // hash of the expiry and extra data
+}
+
+// bucket returns the bucket at names, or nil if the manifest doesn't have it.
+func (m *Manifest) bucket(names ...string) *ManifestBucket {
+	mb := m.Root
+	for _, n := range names {
+		if mb == nil {
+			break
+		}
+		mb = mb.Buckets[n]
+	}
+	return mb
+}
+
+// path returns the bucket at names, creating it if needed.
+func (m *Manifest) path(names []string) *ManifestBucket {
+	if m.Root == nil {
+		m.Root = &ManifestBucket{}
+	}
+	mb := m.Root
+	for _, n := range names {
+		mb = mb.child(n)
+	}
+	return mb
+}
+
+func (mb *ManifestBucket) child(name string) *ManifestBucket {
+	if mb.Buckets == nil {
+		mb.Buckets = map[string]*ManifestBucket{}
+	}
+	cb := mb.Buckets[name]
+	if cb == nil {
+		cb = &ManifestBucket{}
+		mb.Buckets[name] = cb
+	}
+	return cb
+}
+
+func (mb *ManifestBucket) setKey(key string, mk ManifestKey) {
+	if mb.Keys == nil {
+		mb.Keys = map[string]ManifestKey{}
+	}
+	mb.Keys[key] = mk
+}
+
+// ReadManifest returns the manifest of an archive written by ExportWithOptions, r must already be decompressed.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	tr, ok := r.(*tar.Reader)
+	if !ok {
+		tr = tar.NewReader(r)
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, ErrNoManifest
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := hdr.PAXRecords[paxManifest]; !ok {
+			continue
+		}
+		var m Manifest
+		if err = json.NewDecoder(tr).Decode(&m); err != nil {
+			return nil, ErrInvalidArchive
+		}
+		return &m, nil
+	}
+}
+
+// manifestHeader returns the entry ExportWithOptions stores the manifest in, at the end of the archive.
+func manifestHeader(size int) *tar.Header {
+	return &tar.Header{
+		Typeflag:   tar.TypeReg,
+		Name:       ".manifest.json",
+		Mode:       0o644,
+		Size:       int64(size),
+		ModTime:    time.Now(),
+		PAXRecords: map[string]string{paxManifest: "1"},
+		Format:     tar.FormatPAX,
+	}
+}
+
+func writeManifest(tw *tar.Writer, m *Manifest) error {
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(manifestHeader(len(j))); err != nil {
+		return err
+	}
+	_, err = tw.Write(j)
+	return err
+}
+
+// recordsSum hashes the PAX records of a key so the manifest notices changes to its metadata.
+func recordsSum(recs map[string]string) uint64 {
+	ks := make([]string, 0, len(recs))
+	for k := range recs {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	h := fnv.New64a()
+	for _, k := range ks {
+		io.WriteString(h, k)
+		h.Write([]byte{0})
+		io.WriteString(h, recs[k])
+		h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
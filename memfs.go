@@ -0,0 +1,375 @@
+package iodb
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// NewMemFS returns an empty in-memory FS, mostly useful for tests.
+// Like a real filesystem, open files keep their data alive after being renamed over or removed.
+func NewMemFS() FS {
+	return &memFS{root: newMemDir()}
+}
+
+type memFS struct {
+	root *memNode
+	mux  sync.RWMutex
+}
+
+type memNode struct {
+	modTime  time.Time
+	children map[string]*memNode // nil for regular files
+	data     []byte
+	mode     os.FileMode
+	mux      sync.RWMutex
+}
+
+func newMemDir() *memNode {
+	return &memNode{mode: fs.ModeDir | 0o755, modTime: time.Now(), children: map[string]*memNode{}}
+}
+
+func (n *memNode) isDir() bool { return n.children != nil }
+
+// grow extends the data to size, at least doubling its capacity like bytes.Buffer does when it has to reallocate,
+// so a file written a chunk at a time isn't copied on every write. n.mux must be held.
+func (n *memNode) grow(size int64) {
+	if size > int64(cap(n.data)) {
+		c := 2 * int64(cap(n.data))
+		if c < size {
+			c = size
+		}
+		data := make([]byte, len(n.data), c)
+		copy(data, n.data)
+		n.data = data
+	}
+	n.data = n.data[:size]
+}
+
+func (n *memNode) info(name string) os.FileInfo {
+	n.mux.RLock()
+	defer n.mux.RUnlock()
+	return &memFileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+func splitMemPath(p string) []string {
+	p = filepath.ToSlash(filepath.Clean(p))
+	p = strings.Trim(p, "/")
+	if p == "" || p == "." {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+func memErr(op, path string, err error) error {
+	return &fs.PathError{Op: op, Path: path, Err: err}
+}
+
+// lookup must be called with fs.mux held.
+func (mfs *memFS) lookup(op, p string) (*memNode, error) {
+	n := mfs.root
+	for _, part := range splitMemPath(p) {
+		if !n.isDir() {
+			return nil, memErr(op, p, syscall.ENOTDIR)
+		}
+		if n = n.children[part]; n == nil {
+			return nil, memErr(op, p, fs.ErrNotExist)
+		}
+	}
+	return n, nil
+}
+
+// parent must be called with fs.mux held.
+func (mfs *memFS) parent(op, p string) (dir *memNode, name string, err error) {
+	parts := splitMemPath(p)
+	if len(parts) == 0 {
+		return nil, "", memErr(op, p, fs.ErrInvalid)
+	}
+	if dir, err = mfs.lookup(op, strings.Join(parts[:len(parts)-1], "/")); err != nil {
+		return
+	}
+	if !dir.isDir() {
+		return nil, "", memErr(op, p, syscall.ENOTDIR)
+	}
+	return dir, parts[len(parts)-1], nil
+}
+
+func (mfs *memFS) Open(name string) (File, error) {
+	return mfs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (mfs *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+
+	n, err := mfs.lookup("open", name)
+	switch {
+	case err == nil:
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			return nil, memErr("open", name, fs.ErrExist)
+		}
+		if n.isDir() && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, memErr("open", name, syscall.EISDIR)
+		}
+	case flag&os.O_CREATE != 0 && os.IsNotExist(err):
+		var (
+			dir *memNode
+			fn  string
+		)
+		if dir, fn, err = mfs.parent("open", name); err != nil {
+			return nil, err
+		}
+		n = &memNode{mode: perm & fs.ModePerm, modTime: time.Now()}
+		dir.children[fn] = n
+	default:
+		return nil, err
+	}
+
+	if flag&os.O_TRUNC != 0 && !n.isDir() {
+		n.mux.Lock()
+		n.data, n.modTime = nil, time.Now()
+		n.mux.Unlock()
+	}
+
+	return &memFile{node: n, name: name, flag: flag}, nil
+}
+
+func (mfs *memFS) Stat(name string) (os.FileInfo, error) {
+	mfs.mux.RLock()
+	defer mfs.mux.RUnlock()
+	n, err := mfs.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(filepath.Base(name)), nil
+}
+
+func (mfs *memFS) Rename(oldpath, newpath string) error {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+
+	odir, oname, err := mfs.parent("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	n := odir.children[oname]
+	if n == nil {
+		return memErr("rename", oldpath, fs.ErrNotExist)
+	}
+	ndir, nname, err := mfs.parent("rename", newpath)
+	if err != nil {
+		return err
+	}
+	if on := ndir.children[nname]; on != nil && on != n {
+		switch {
+		case on.isDir() && !n.isDir():
+			return memErr("rename", newpath, syscall.EISDIR)
+		case !on.isDir() && n.isDir():
+			return memErr("rename", newpath, syscall.ENOTDIR)
+		case on.isDir() && len(on.children) > 0:
+			return memErr("rename", newpath, syscall.ENOTEMPTY)
+		}
+	}
+	delete(odir.children, oname)
+	ndir.children[nname] = n
+	return nil
+}
+
+func (mfs *memFS) Link(oldname, newname string) error {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+	n, err := mfs.lookup("link", oldname)
+	if err != nil {
+		return err
+	}
+	if n.isDir() {
+		return memErr("link", oldname, fs.ErrPermission)
+	}
+	dir, fn, err := mfs.parent("link", newname)
+	if err != nil {
+		return err
+	}
+	if dir.children[fn] != nil {
+		return memErr("link", newname, fs.ErrExist)
+	}
+	dir.children[fn] = n
+	return nil
+}
+
+func (mfs *memFS) Remove(name string) error {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+	dir, fn, err := mfs.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	n := dir.children[fn]
+	if n == nil {
+		return memErr("remove", name, fs.ErrNotExist)
+	}
+	if n.isDir() && len(n.children) > 0 {
+		return memErr("remove", name, syscall.ENOTEMPTY)
+	}
+	delete(dir.children, fn)
+	return nil
+}
+
+func (mfs *memFS) RemoveAll(path string) error {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+	dir, fn, err := mfs.parent("removeall", path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	delete(dir.children, fn)
+	return nil
+}
+
+func (mfs *memFS) MkdirAll(path string, perm os.FileMode) error {
+	mfs.mux.Lock()
+	defer mfs.mux.Unlock()
+	n := mfs.root
+	for _, part := range splitMemPath(path) {
+		c := n.children[part]
+		if c == nil {
+			c = newMemDir()
+			c.mode = fs.ModeDir | perm&fs.ModePerm
+			n.children[part] = c
+		} else if !c.isDir() {
+			return memErr("mkdir", path, syscall.ENOTDIR)
+		}
+		n = c
+	}
+	return nil
+}
+
+func (mfs *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	mfs.mux.RLock()
+	defer mfs.mux.RUnlock()
+	n, err := mfs.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.isDir() {
+		return nil, memErr("readdir", name, syscall.ENOTDIR)
+	}
+	out := make([]fs.DirEntry, 0, len(n.children))
+	for cn, c := range n.children {
+		out = append(out, fs.FileInfoToDirEntry(c.info(cn)))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name() < out[j].Name() })
+	return out, nil
+}
+
+type memFile struct {
+	node   *memNode
+	name   string
+	off    int64
+	flag   int
+	closed bool
+}
+
+func (f *memFile) checkRead() error {
+	if f.closed {
+		return memErr("read", f.name, fs.ErrClosed)
+	}
+	if f.node.isDir() {
+		return memErr("read", f.name, syscall.EISDIR)
+	}
+	if f.flag&os.O_WRONLY != 0 {
+		return memErr("read", f.name, syscall.EBADF)
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (n int, err error) {
+	if n, err = f.ReadAt(p, f.off); err == io.EOF && n > 0 {
+		err = nil
+	}
+	f.off += int64(n)
+	return
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if err = f.checkRead(); err != nil {
+		return
+	}
+	if off < 0 {
+		return 0, memErr("readat", f.name, fs.ErrInvalid)
+	}
+	f.node.mux.RLock()
+	defer f.node.mux.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	if n = copy(p, f.node.data[off:]); n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (f *memFile) Write(p []byte) (n int, err error) {
+	if f.closed {
+		return 0, memErr("write", f.name, fs.ErrClosed)
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, memErr("write", f.name, syscall.EBADF)
+	}
+	f.node.mux.Lock()
+	defer f.node.mux.Unlock()
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.node.data))
+	}
+	if end := f.off + int64(len(p)); end > int64(len(f.node.data)) {
+		f.node.grow(end)
+	}
+	n = copy(f.node.data[f.off:], p)
+	f.off += int64(n)
+	f.node.modTime = time.Now()
+	return
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return memErr("close", f.name, fs.ErrClosed)
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, memErr("stat", f.name, fs.ErrClosed)
+	}
+	return f.node.info(filepath.Base(f.name)), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return memErr("sync", f.name, fs.ErrClosed)
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	modTime time.Time
+	name    string
+	size    int64
+	mode    os.FileMode
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() any           { return nil }
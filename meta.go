@@ -5,15 +5,26 @@ import (
 	"math/big"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 var one = big.NewInt(1)
 
 type metadata struct {
-	Counter    *big.Int                     `json:"counter"`
-	ExpiryDate map[string]int64             `json:"expiryDate,omitempty"`
-	Extra      map[string]map[string]string `json:"extra,omitempty"`
-	path       string
+	Counter        *big.Int                     `json:"counter"`
+	ExpiryDate     map[string]int64             `json:"expiryDate,omitempty"`
+	Sliding        map[string]int64             `json:"sliding,omitempty"` // key -> window in nanoseconds
+	Extra          map[string]map[string]string `json:"extra,omitempty"`
+	Archive        []string                     `json:"archive,omitempty"`      // see ExpiryPolicy.Archive
+	DefaultTTL     int64                        `json:"defaultTTL,omitempty"`   // nanoseconds
+	BucketExpiry   int64                        `json:"bucketExpiry,omitempty"` // unix seconds
+	Layout         Layout                       `json:"layout,omitempty"`
+	LongKeys       map[string]string            `json:"longKeys,omitempty"`       // file name -> key, see keyFileName
+	Changed        map[string]int64             `json:"changed,omitempty"`        // key -> unix nanoseconds, see Options.ChangeRetention
+	DeletedBuckets map[string]int64             `json:"deletedBuckets,omitempty"` // child bucket name -> unix nanoseconds
+	db             *DB
+	path           string
+	dirty          bool // changed without being stored, see flushMetaLocked
 }
 
 func (m *metadata) incCounter() *big.Int {
@@ -35,6 +46,22 @@ func (m *metadata) SetExpiryDate(path string, ts int64) {
 
 }
 
+func (m *metadata) SetSliding(path string, window time.Duration) {
+	if window <= 0 {
+		if m.Sliding != nil {
+			delete(m.Sliding, path)
+			if len(m.Sliding) == 0 {
+				m.Sliding = nil
+			}
+		}
+		return
+	}
+	if m.Sliding == nil {
+		m.Sliding = map[string]int64{}
+	}
+	m.Sliding[path] = int64(window)
+}
+
 func (m *metadata) SetExtraData(path string, key string, val string) {
 	if m.Extra == nil {
 		if val == "" {
@@ -63,6 +90,58 @@ func (m *metadata) SetExtraData(path string, key string, val string) {
 	}
 }
 
+// SetChanged records that key got written, deleted, renamed or had its metadata changed,
+// the modification time of its file doesn't show most of that, and comes from a clock coarser than time.Now,
+// so a write right after an export can look older than it.
+func (m *metadata) SetChanged(key string) {
+	m.track(&m.Changed, key)
+}
+
+// SetBucketDeleted records that the child bucket name got deleted.
+func (m *metadata) SetBucketDeleted(name string) {
+	m.track(&m.DeletedBuckets, name)
+}
+
+func (m *metadata) track(changes *map[string]int64, name string) {
+	if m.db.opts.ChangeRetention <= 0 {
+		return
+	}
+	if *changes == nil {
+		*changes = map[string]int64{}
+	}
+	(*changes)[name] = time.Now().UnixNano()
+	m.dirty = true // callers that don't store it leave it to flushMetaLocked
+}
+
+// pruneChanges forgets the changes older than Options.ChangeRetention.
+func (m *metadata) pruneChanges() {
+	oldest := time.Now().Add(-m.db.opts.ChangeRetention).UnixNano()
+	for _, changes := range []map[string]int64{m.Changed, m.DeletedBuckets} {
+		for n, ts := range changes {
+			if ts < oldest {
+				delete(changes, n)
+			}
+		}
+	}
+	if len(m.Changed) == 0 {
+		m.Changed = nil
+	}
+	if len(m.DeletedBuckets) == 0 {
+		m.DeletedBuckets = nil
+	}
+}
+
+// nextExpiry returns the earliest expiry of the bucket or any of its keys in unix seconds, 0 if nothing expires.
+func (m *metadata) nextExpiry() (next int64) {
+	next = m.BucketExpiry
+	for _, ts := range m.ExpiryDate {
+		if ts != 0 && (next == 0 || ts < next) {
+			next = ts
+		}
+	}
+	return
+}
+
 func (m *metadata) CopyExtra(path string) (out map[string]string) {
 	mm := m.Extra[path]
 	out = make(map[string]string, len(mm))
@@ -73,12 +152,22 @@ func (m *metadata) CopyExtra(path string) (out map[string]string) {
 	return
 }
 
+// store writes the metadata to disk, syncing the file depending on the SyncMode,
+// it is up to the caller to call DB.fsyncDir once it released its locks.
 func (m *metadata) store() (err error) {
-	var f *os.File
-	tmpPath := m.path + ".tmp"
-	if f, err = os.Create(tmpPath); err != nil {
+	var f File
+	m.pruneChanges()
+	dir, next := filepath.Dir(m.path), m.nextExpiry()
+	if err = m.db.expiries.lower(dir, next); err != nil {
+		return
+	}
+	tmpPath := filepath.Join(dir, metaTmpName)
+	if f, err = m.db.fs.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644); err != nil {
 		return err
 	}
+	if m.db.opts.SyncMode >= SyncData {
+		f = syncCloser{f}
+	}
 	if err = json.NewEncoder(f).Encode(m); err != nil {
 		f.Close() // can't defer it because we wanna close it before the rename :|
 		return err
@@ -86,17 +175,27 @@ func (m *metadata) store() (err error) {
 	if err = f.Close(); err != nil {
 		return
 	}
-	return os.Rename(tmpPath, m.path)
+	if err = m.db.fs.Rename(tmpPath, m.path); err == nil {
+		m.dirty = false
+		m.db.expiries.set(dir, next)
+	}
+	return
 }
 
-func loadMetadata(p string) (*metadata, error) {
-	p = filepath.Join(p, ".meta")
-	m := &metadata{Counter: big.NewInt(0), path: p}
-	f, err := os.Open(p)
+const (
+	metaName    = ".meta"
+	metaTmpName = metaName + ".tmp"
+)
+
+func newMetadata(db *DB, path string) *metadata {
+	return &metadata{Counter: big.NewInt(0), db: db, path: path}
+}
+
+// loadMetadataFile decodes the metadata stored in src, path is where it will be stored.
+func loadMetadataFile(db *DB, src, path string) (*metadata, error) {
+	m := newMetadata(db, path)
+	f, err := db.fs.Open(src)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return m, nil
-		}
 		return nil, err
 	}
 
@@ -109,5 +208,9 @@ func loadMetadata(p string) (*metadata, error) {
 		return nil, err
 	}
 
+	if m.Counter == nil { // "counter": null
+		m.Counter = big.NewInt(0)
+	}
+
 	return m, nil
 }
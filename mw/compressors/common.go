@@ -1,6 +1,7 @@
 package compressors
 
 import (
+	"bytes"
 	"io"
 
 	"github.com/alpineiq/iodb/mw"
@@ -9,7 +10,8 @@ import (
 
 const (
 
-	// ErrInvalidCompressor is returned when an invalid compressor is provided to NewCompressorByExt
+	// ErrInvalidCompressor is returned when an invalid compressor is provided to NewCompressorByExt,
+	// or NewCompressorByMagic doesn't recognize the data
 	ErrInvalidCompressor = oerrs.String("invalid compressor")
 
 	// ErrRawCompressor is returned when a raw compressor is provided to NewCompressorByExt
@@ -54,6 +56,8 @@ func NewCompressorByExt(ext string) (comp mw.Middleware, err error) {
 		comp = NewGzip(6)
 	case "snappy":
 		comp = NewSnappy()
+	case "flate", "deflate":
+		comp = NewFlate(6)
 	case "log", "txt", "raw":
 		err = ErrRawCompressor
 	default:
@@ -62,3 +66,23 @@ func NewCompressorByExt(ext string) (comp mw.Middleware, err error) {
 
 	return
 }
+
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	snappyMagic = []byte("\xff\x06\x00\x00sNaPpY")
+)
+
+// NewCompressorByMagic returns a compressor middleware that can read data starting with head.
+// it only knows gzip and snappy, flate streams don't have a header to detect them by.
+func NewCompressorByMagic(head []byte) (comp mw.Middleware, err error) {
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		comp = NewGzip(6)
+	case bytes.HasPrefix(head, snappyMagic):
+		comp = NewSnappy()
+	default:
+		err = ErrInvalidCompressor
+	}
+
+	return
+}
@@ -0,0 +1,367 @@
+package compressors
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/golang/snappy"
+	"go.oneofone.dev/oerrs"
+)
+
+const (
+	// ErrInvalidSeekable is returned when a value doesn't end with a valid seekable index
+	ErrInvalidSeekable = oerrs.String("invalid seekable compressed data")
+	// ErrInvalidBlockSize is returned by Seekable.Writer if BlockSize is <= 0 or > MaxBlockSize
+	ErrInvalidBlockSize = oerrs.String("invalid seekable block size")
+	// ErrBlockTooLarge is returned when a compressed block doesn't fit in the index
+	ErrBlockTooLarge = oerrs.String("compressed block too large")
+)
+
+// DefaultBlockSize is the block size used when a Seekable compressor is created with a block size <= 0
+const DefaultBlockSize = 64 * 1024
+
+// MaxBlockSize is the largest block size, the index stores sizes as uint32s and this leaves room
+// for blocks that grow when compressed. Larger block sizes passed to the constructors are lowered to it.
+const MaxBlockSize = 1 << 30
+
+// the footer is the index (an uint32 compressed size and an uint32 uncompressed size per block),
+// followed by the trailer: the number of blocks as an uint64 and the magic.
+const (
+	seekableMagic   = "IODBSEEK"
+	indexEntrySize  = 8
+	seekTrailerSize = 8 + len(seekableMagic)
+)
+
+type blockCodec interface {
+	compress(src []byte) ([]byte, error)
+	decompress(src []byte, size int) ([]byte, error)
+}
+
+// NewSeekableGzip returns a Seekable compressor that gzips every block
+func NewSeekableGzip(level, blockSize int) Seekable {
+	return newSeekable("Seekable Gzip Compressor", gzipCodec(level), blockSize)
+}
+
+// NewSeekableFlate returns a Seekable compressor that deflates every block
+func NewSeekableFlate(level, blockSize int) Seekable {
+	return newSeekable("Seekable Flate Compressor", flateCodec(level), blockSize)
+}
+
+// NewSeekableSnappy returns a Seekable compressor that snappy encodes every block
+func NewSeekableSnappy(blockSize int) Seekable {
+	return newSeekable("Seekable Snappy Compressor", snappyCodec{}, blockSize)
+}
+
+func newSeekable(name string, c blockCodec, blockSize int) Seekable {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	} else if blockSize > MaxBlockSize {
+		blockSize = MaxBlockSize
+	}
+	return Seekable{BlockSize: blockSize, name: name, codec: c}
+}
+
+// Seekable compresses values as independently compressed blocks followed by an index,
+// its readers implement io.ReaderAt and io.Seeker so compressed values still support range reads.
+// Random access needs the parent reader to implement io.ReaderAt (it does if Seekable is the first middleware),
+// otherwise the whole value is read into memory.
+type Seekable struct {
+	BlockSize int
+	name      string
+	codec     blockCodec
+}
+
+// Name returns the name of the compressor type
+func (s Seekable) Name() string {
+	return s.name
+}
+
+// CanAppend returns false, appending would end up after the index, see mw.Appender
+func (s Seekable) CanAppend() bool {
+	return false
+}
+
+// Writer returns a new block writer, closing it writes the index but doesn't close w
+func (s Seekable) Writer(path string, w io.Writer) (io.WriteCloser, error) {
+	if s.BlockSize <= 0 || s.BlockSize > MaxBlockSize {
+		return nil, ErrInvalidBlockSize
+	}
+	return &seekableWriter{w: w, codec: s.codec, buf: make([]byte, 0, s.BlockSize)}, nil
+}
+
+// Reader returns a reader that implements io.ReaderAt and io.Seeker
+func (s Seekable) Reader(path string, r io.Reader, st os.FileInfo) (io.ReadCloser, error) {
+	var (
+		ra   io.ReaderAt
+		size int64
+	)
+	if sz, ok := r.(interface{ Size() int64 }); ok {
+		size = sz.Size()
+	} else if st != nil {
+		size = st.Size()
+	}
+	if rat, ok := r.(io.ReaderAt); ok {
+		ra = rat
+	} else {
+		b, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		ra, size = bytes.NewReader(b), int64(len(b))
+	}
+	return newSeekableReader(ra, size, s.codec)
+}
+
+type seekableWriter struct {
+	w     io.Writer
+	codec blockCodec
+	buf   []byte
+	index []byte
+	n     uint64
+}
+
+func (sw *seekableWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		c := copy(sw.buf[len(sw.buf):cap(sw.buf)], p)
+		sw.buf = sw.buf[:len(sw.buf)+c]
+		p, n = p[c:], n+c
+		if len(sw.buf) == cap(sw.buf) {
+			if err = sw.flush(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (sw *seekableWriter) flush() error {
+	if len(sw.buf) == 0 {
+		return nil
+	}
+	cb, err := sw.codec.compress(sw.buf)
+	if err != nil {
+		return err
+	}
+	if uint64(len(cb)) > math.MaxUint32 {
+		return ErrBlockTooLarge
+	}
+	if _, err = sw.w.Write(cb); err != nil {
+		return err
+	}
+	sw.index = binary.LittleEndian.AppendUint32(sw.index, uint32(len(cb)))
+	sw.index = binary.LittleEndian.AppendUint32(sw.index, uint32(len(sw.buf)))
+	sw.n++
+	sw.buf = sw.buf[:0]
+	return nil
+}
+
+func (sw *seekableWriter) Close() (err error) {
+	if err = sw.flush(); err != nil {
+		return
+	}
+	footer := binary.LittleEndian.AppendUint64(sw.index, sw.n)
+	footer = append(footer, seekableMagic...)
+	_, err = sw.w.Write(footer)
+	return
+}
+
+type seekableReader struct {
+	ra    io.ReaderAt
+	codec blockCodec
+	coffs []int64 // compressed block offsets, with an extra entry for the end
+	uoffs []int64 // uncompressed block offsets, with an extra entry for the total size
+	off   int64
+
+	mux    sync.Mutex
+	cached int
+	block  []byte
+}
+
+func newSeekableReader(ra io.ReaderAt, size int64, codec blockCodec) (*seekableReader, error) {
+	if size < int64(seekTrailerSize) {
+		return nil, ErrInvalidSeekable
+	}
+	trailer := make([]byte, seekTrailerSize)
+	if _, err := ra.ReadAt(trailer, size-int64(seekTrailerSize)); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if string(trailer[8:]) != seekableMagic {
+		return nil, ErrInvalidSeekable
+	}
+	n := binary.LittleEndian.Uint64(trailer)
+	if n > uint64(size)/indexEntrySize {
+		return nil, ErrInvalidSeekable
+	}
+	indexStart := size - int64(seekTrailerSize) - int64(n)*indexEntrySize
+	if indexStart < 0 {
+		return nil, ErrInvalidSeekable
+	}
+	index := make([]byte, n*indexEntrySize)
+	if _, err := ra.ReadAt(index, indexStart); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	sr := &seekableReader{
+		ra:     ra,
+		codec:  codec,
+		coffs:  make([]int64, n+1),
+		uoffs:  make([]int64, n+1),
+		cached: -1,
+	}
+	for i := uint64(0); i < n; i++ {
+		e := index[i*indexEntrySize:]
+		sr.coffs[i+1] = sr.coffs[i] + int64(binary.LittleEndian.Uint32(e))
+		sr.uoffs[i+1] = sr.uoffs[i] + int64(binary.LittleEndian.Uint32(e[4:]))
+	}
+	if sr.coffs[n] != indexStart {
+		return nil, ErrInvalidSeekable
+	}
+	return sr, nil
+}
+
+// Size returns the uncompressed size
+func (sr *seekableReader) Size() int64 {
+	return sr.uoffs[len(sr.uoffs)-1]
+}
+
+func (sr *seekableReader) Read(p []byte) (n int, err error) {
+	if n, err = sr.ReadAt(p, sr.off); err == io.EOF && n > 0 {
+		err = nil
+	}
+	sr.off += int64(n)
+	return
+}
+
+func (sr *seekableReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	sr.mux.Lock()
+	defer sr.mux.Unlock()
+	for n < len(p) {
+		if off >= sr.Size() {
+			return n, io.EOF
+		}
+		i := sort.Search(len(sr.uoffs)-1, func(i int) bool { return sr.uoffs[i+1] > off })
+		if err = sr.load(i); err != nil {
+			return
+		}
+		c := copy(p[n:], sr.block[off-sr.uoffs[i]:])
+		n, off = n+c, off+int64(c)
+	}
+	return
+}
+
+// load must be called with sr.mux held.
+func (sr *seekableReader) load(i int) (err error) {
+	if sr.cached == i {
+		return
+	}
+	cb := make([]byte, sr.coffs[i+1]-sr.coffs[i])
+	if _, err = sr.ra.ReadAt(cb, sr.coffs[i]); err != nil && err != io.EOF {
+		return
+	}
+	size := int(sr.uoffs[i+1] - sr.uoffs[i])
+	if sr.block, err = sr.codec.decompress(cb, size); err != nil {
+		return
+	}
+	if len(sr.block) != size {
+		return ErrInvalidSeekable
+	}
+	sr.cached = i
+	return nil
+}
+
+func (sr *seekableReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += sr.off
+	case io.SeekEnd:
+		offset += sr.Size()
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	sr.off = offset
+	return offset, nil
+}
+
+// Close doesn't close the parent reader
+func (sr *seekableReader) Close() error {
+	return nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) compress(src []byte) ([]byte, error) {
+	return snappy.Encode(nil, src), nil
+}
+
+func (snappyCodec) decompress(src []byte, _ int) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+type flateCodec int
+
+func (c flateCodec) compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, int(c))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = fw.Write(src); err != nil {
+		return nil, err
+	}
+	if err = fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) decompress(src []byte, size int) ([]byte, error) {
+	return readBlock(flate.NewReader(bytes.NewReader(src)), size)
+}
+
+type gzipCodec int
+
+func (c gzipCodec) compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gw, err := gzip.NewWriterLevel(&buf, int(c))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = gw.Write(src); err != nil {
+		return nil, err
+	}
+	if err = gw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) decompress(src []byte, size int) ([]byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	return readBlock(gr, size)
+}
+
+func readBlock(rc io.ReadCloser, size int) ([]byte, error) {
+	defer rc.Close()
+	b := make([]byte, size)
+	if _, err := io.ReadFull(rc, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,95 @@
+package compressors
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func seekableData() string {
+	var sb strings.Builder
+	for i := 0; sb.Len() < 10000; i++ {
+		sb.WriteString("line " + strconv.Itoa(i) + " of some compressible data\n")
+	}
+	return sb.String()
+}
+
+func TestSeekable(t *testing.T) {
+	data := seekableData()
+	for _, s := range []Seekable{
+		NewSeekableGzip(6, 1000),
+		NewSeekableFlate(6, 1000),
+		NewSeekableSnappy(1000),
+	} {
+		var buf bytes.Buffer
+		w, err := s.Writer("", &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.WriteString(w, data); err != nil {
+			t.Fatal(err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() >= len(data) {
+			t.Fatalf("%s: value didn't get compressed (%d bytes)", s.Name(), buf.Len())
+		}
+
+		rc, err := s.Reader("", bytes.NewReader(buf.Bytes()), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(rc)
+		if err != nil || string(b) != data {
+			t.Fatalf("%s: the value didn't round trip (%v)", s.Name(), err)
+		}
+
+		// crosses a block boundary
+		p := make([]byte, 20)
+		if _, err = rc.(io.ReaderAt).ReadAt(p, 990); err != nil || string(p) != data[990:1010] {
+			t.Fatalf("%s: expected %q, got %q (%v)", s.Name(), data[990:1010], p, err)
+		}
+		if _, err = rc.(io.Seeker).Seek(-10, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		if b, _ = io.ReadAll(rc); string(b) != data[len(data)-10:] {
+			t.Fatalf("%s: expected %q, got %q", s.Name(), data[len(data)-10:], b)
+		}
+		rc.Close()
+
+		// without io.ReaderAt the value is read into memory
+		if rc, err = s.Reader("", io.MultiReader(bytes.NewReader(buf.Bytes())), nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = rc.(io.ReaderAt).ReadAt(p, 1990); err != nil || string(p) != data[1990:2010] {
+			t.Fatalf("%s: expected %q, got %q (%v)", s.Name(), data[1990:2010], p, err)
+		}
+		rc.Close()
+
+		// the index isn't at the end anymore
+		buf.WriteString("appended")
+		if _, err = s.Reader("", bytes.NewReader(buf.Bytes()), nil); !errors.Is(err, ErrInvalidSeekable) {
+			t.Fatalf("%s: expected ErrInvalidSeekable, got %v", s.Name(), err)
+		}
+		if s.CanAppend() {
+			t.Fatalf("%s: expected CanAppend to be false", s.Name())
+		}
+	}
+}
+
+func TestSeekableBlockSize(t *testing.T) {
+	s := NewSeekableSnappy(MaxBlockSize + 1)
+	if s.BlockSize != MaxBlockSize {
+		t.Fatalf("expected the block size to be lowered to %d, got %d", MaxBlockSize, s.BlockSize)
+	}
+	for _, bs := range []int{-1, 0, MaxBlockSize + 1} {
+		s.BlockSize = bs
+		if _, err := s.Writer("", io.Discard); !errors.Is(err, ErrInvalidBlockSize) {
+			t.Fatalf("%d: expected ErrInvalidBlockSize, got %v", bs, err)
+		}
+	}
+}
@@ -11,3 +11,9 @@ type Middleware interface {
 	Writer(path string, w io.Writer) (io.WriteCloser, error) // calling Close on the returned writer must ***NOT*** close the parent.
 	Reader(path string, r io.Reader, st os.FileInfo) (io.ReadCloser, error)
 }
+
+// Appender is implemented by middlewares that know whether a value they wrote can be appended to,
+// Append fails with iodb.ErrNotAppendable if CanAppend returns false, middlewares that don't implement it can be.
+type Appender interface {
+	CanAppend() bool
+}
@@ -0,0 +1,214 @@
+package iodb
+
+import (
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const quarantineDirName = ".quarantine"
+
+// RecoveryReport describes everything New had to fix up after an unclean shutdown.
+type RecoveryReport struct {
+	// RemovedTempFiles are temp files left behind by interrupted writes.
+	RemovedTempFiles []string
+	// KeptTempFiles look like temp files from before they were hidden, but they're valid keys too,
+	// so they're left alone in case they are.
+	KeptTempFiles []string
+	// QuarantinedFiles maps files moved into the quarantine directory to their new path,
+	// corrupt metadata ends up here, and temp files with QuarantineTempFiles set.
+	QuarantinedFiles map[string]string
+	// RebuiltMeta are buckets with a missing or corrupt .meta file that got rebuilt.
+	RebuiltMeta []string
+	// ReplayedTxns are committed transactions that got applied.
+	ReplayedTxns []string
+	// RolledBackTxns are uncommitted transactions that got discarded.
+	RolledBackTxns []string
+	// FailedTxnOps are the parts of committed transactions that couldn't be replayed,
+	// either "<txn>/<op index>: <error>" for an op that got skipped or "<txn>: <error>".
+	FailedTxnOps []string
+
+	mux sync.Mutex
+}
+
+// Empty returns true if nothing needed recovering.
+func (r *RecoveryReport) Empty() bool {
+	return len(r.RemovedTempFiles) == 0 && len(r.KeptTempFiles) == 0 && len(r.QuarantinedFiles) == 0 &&
+		len(r.RebuiltMeta) == 0 && len(r.ReplayedTxns) == 0 && len(r.RolledBackTxns) == 0 &&
+		len(r.FailedTxnOps) == 0
+}
+
+func (r *RecoveryReport) String() string {
+	if r.Empty() {
+		return "nothing to recover"
+	}
+	var sb strings.Builder
+	for _, p := range r.RemovedTempFiles {
+		fmt.Fprintf(&sb, "removed temp file %s\n", p)
+	}
+	for _, p := range r.KeptTempFiles {
+		fmt.Fprintf(&sb, "kept %s, it could be a temp file or a key\n", p)
+	}
+	for p, np := range r.QuarantinedFiles {
+		fmt.Fprintf(&sb, "quarantined %s to %s\n", p, np)
+	}
+	for _, p := range r.RebuiltMeta {
+		fmt.Fprintf(&sb, "rebuilt metadata for %s\n", p)
+	}
+	for _, id := range r.ReplayedTxns {
+		fmt.Fprintf(&sb, "replayed transaction %s\n", id)
+	}
+	for _, id := range r.RolledBackTxns {
+		fmt.Fprintf(&sb, "rolled back transaction %s\n", id)
+	}
+	for _, f := range r.FailedTxnOps {
+		fmt.Fprintf(&sb, "failed to replay transaction %s\n", f)
+	}
+	return strings.TrimSuffix(sb.String(), "\n")
+}
+
+func (r *RecoveryReport) add(l *[]string, v string) {
+	r.mux.Lock()
+	*l = append(*l, v)
+	r.mux.Unlock()
+}
+
+func (r *RecoveryReport) quarantined(p, np string) {
+	r.mux.Lock()
+	if r.QuarantinedFiles == nil {
+		r.QuarantinedFiles = map[string]string{}
+	}
+	r.QuarantinedFiles[p] = np
+	r.mux.Unlock()
+}
+
+// RecoveryReport returns what New had to recover when opening the database.
+func (db *DB) RecoveryReport() *RecoveryReport {
+	return db.recovery
+}
+
+// quarantine moves path under the root's quarantine directory instead of deleting it.
+func (db *DB) quarantine(path string) (err error) {
+	rel, err := filepath.Rel(db.rootPath, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(path)
+	}
+	nPath := filepath.Join(db.rootPath, quarantineDirName, rel+"."+strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err = db.fs.MkdirAll(filepath.Dir(nPath), 0o755); err != nil {
+		return
+	}
+	if err = db.fs.Rename(path, nPath); err != nil {
+		return
+	}
+	db.recovery.quarantined(path, nPath)
+	return
+}
+
+// removeTempFiles cleans up after interrupted writes, it must be called before the bucket is loaded.
+func (b *bucket) removeTempFiles() error {
+	sds, err := shardDirs(b.db.fs, b.path)
+	if err != nil {
+		return err
+	}
+	for _, dir := range append([]string{b.path}, sds...) {
+		if err = b.removeTempFilesIn(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bucket) removeTempFilesIn(dir string) error {
+	des, err := b.db.fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, de := range des {
+		fn := de.Name()
+		if !de.Type().IsRegular() || fn == metaTmpName { // .meta.tmp is handled by loadMeta
+			continue
+		}
+		ok, legacy := isTempFile(fn)
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, fn)
+		if legacy {
+			if _, err := b.db.decodeKey(fn); err == nil {
+				// it could be a real key that happens to look like a temp file, only names that can't be keys go.
+				b.db.recovery.add(&b.db.recovery.KeptTempFiles, path)
+				continue
+			}
+		}
+		if b.db.opts.QuarantineTempFiles {
+			err = b.db.quarantine(path)
+		} else if err = b.db.fs.Remove(path); err == nil {
+			b.db.recovery.add(&b.db.recovery.RemovedTempFiles, path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openMeta loads the bucket's metadata, recovering it from an interrupted store if possible,
+// if it returns with lost set, the bucket needs rebuildMeta once the keys are loaded.
+func (b *bucket) openMeta() (lost, corrupt bool, err error) {
+	var (
+		fs       = b.db.fs
+		metaPath = filepath.Join(b.path, metaName)
+		metaTmp  = filepath.Join(b.path, metaTmpName)
+	)
+
+	if b.meta, err = loadMetadataFile(b.db, metaPath, metaPath); err == nil {
+		// a leftover .meta.tmp is from an interrupted store that never got renamed.
+		if _, serr := fs.Stat(metaTmp); serr == nil {
+			if err = fs.Remove(metaTmp); err == nil {
+				b.db.recovery.add(&b.db.recovery.RemovedTempFiles, metaTmp)
+			}
+		}
+		return
+	}
+
+	if corrupt = !os.IsNotExist(err); corrupt {
+		log.Printf("iodb: corrupt metadata (%s): %v", metaPath, err)
+		if err = b.db.quarantine(metaPath); err != nil {
+			return
+		}
+	}
+
+	// try the last store that didn't get renamed
+	if b.meta, err = loadMetadataFile(b.db, metaTmp, metaPath); err == nil {
+		if err = b.meta.store(); err == nil {
+			b.db.recovery.add(&b.db.recovery.RebuiltMeta, b.path)
+		}
+		return false, corrupt, err
+	}
+	if !os.IsNotExist(err) {
+		if err = b.db.quarantine(metaTmp); err != nil {
+			return
+		}
+	}
+
+	b.meta = newMetadata(b.db, metaPath)
+	return true, corrupt, nil
+}
+
+// rebuildMeta recreates the metadata of a bucket that lost it, it's a no-op for new empty buckets.
+func (b *bucket) rebuildMeta(corrupt bool) error {
+	if b.keys.Len() == 0 && !corrupt {
+		return nil
+	}
+	// we can't know how many ids were handed out, but it's at least the number of keys.
+	b.meta.Counter = big.NewInt(int64(b.keys.Len()))
+	b.db.recovery.add(&b.db.recovery.RebuiltMeta, b.path)
+	return b.meta.store()
+}
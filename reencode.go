@@ -0,0 +1,312 @@
+package iodb
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// reencodeSuffix marks files and buckets halfway through Reencode, they're hidden so they can't clash with
+	// the names of other keys.
+	reencodeSuffix = ".reencode"
+	// reencodeJournalName is where Reencode keeps its moves in the root of the database until they're all done.
+	reencodeJournalName = ".reencode"
+)
+
+// Reencode renames the keys and buckets of the database at path from one KeyEncoder to another,
+// opts.KeyEncoder and opts.PlainFileNames are ignored.
+// the database must not be open anywhere else. Every move is journaled before anything gets renamed,
+// if a previous call got interrupted, Reencode finishes it instead and returns, from and to are ignored then.
+// it fails with ErrInvalidName before changing anything if a name doesn't decode with from, and doesn't expire any keys.
+func Reencode(path string, from, to KeyEncoder, opts *Options) (err error) {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	o.KeyEncoder, o.PlainFileNames = from, false
+	o.LazyLoad, o.MaxResidentBuckets = false, 0
+	fsys := o.FS
+	if fsys == nil {
+		fsys = OSFS()
+	}
+
+	var (
+		root  = filepath.Clean(path)
+		jpath = filepath.Join(root, reencodeJournalName)
+		j     reencodeJournal
+	)
+	if err = readJSONFile(fsys, jpath, &j); err == nil {
+		return j.run(fsys, root, jpath)
+	} else if !os.IsNotExist(err) {
+		return
+	}
+
+	// reload skips names that don't decode, they'd be left behind, and a wrong from can decode others to garbage.
+	if err = checkNames(fsys, from, root); err != nil {
+		return
+	}
+
+	var db *DB
+	if db, err = newDB(path, &o, false); err != nil { // nothing can expire while files are moving around
+		return
+	}
+
+	if kc, ok := to.(KeyChecker); ok {
+		err = db.root.checkKeys(kc)
+	}
+	if err == nil {
+		err = j.plan(db.root, to)
+	}
+	if cerr := db.Close(context.Background()); err == nil {
+		err = cerr
+	}
+	if err != nil || len(j.Steps) == 0 {
+		return
+	}
+
+	var b []byte
+	if b, err = json.Marshal(&j); err != nil {
+		return
+	}
+	if err = writeFileSync(fsys, jpath, b); err != nil {
+		return
+	}
+	return j.run(fsys, root, jpath)
+}
+
+// checkKeys makes sure every key and bucket name can be encoded before anything gets renamed.
+func (b *bucket) checkKeys(kc KeyChecker) (err error) {
+	if err = b.rlock(); err != nil {
+		return
+	}
+	defer b.mux.RUnlock()
+	for _, key := range b.keys.Names(false) {
+		if err = kc.CheckKey(key); err != nil {
+			return
+		}
+	}
+	for name, cb := range b.buckets {
+		if err = kc.CheckKey(name); err != nil {
+			return
+		}
+		if err = cb.checkKeys(kc); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// checkNames makes sure every key and bucket name under dir decodes with enc.
+func checkNames(fsys FS, enc KeyEncoder, dir string) (err error) {
+	files, dirs, err := lsDir(fsys, dir)
+	if err != nil {
+		return
+	}
+	paths := make([]string, 0, len(files))
+	for _, fi := range files {
+		paths = append(paths, filepath.Join(dir, fi.Name()))
+	}
+	var sds []string
+	if sds, err = shardDirs(fsys, dir); err != nil {
+		return
+	}
+	for _, sd := range sds {
+		var sfiles []os.FileInfo
+		if sfiles, _, err = lsDir(fsys, sd); err != nil {
+			return
+		}
+		for _, fi := range sfiles {
+			paths = append(paths, filepath.Join(sd, fi.Name()))
+		}
+	}
+	for _, fi := range dirs {
+		paths = append(paths, filepath.Join(dir, fi.Name()))
+	}
+
+	for _, p := range paths {
+		if fn := filepath.Base(p); !isLongKeyFile(fn) {
+			if _, err = enc.Decode(fn); err != nil {
+				return &os.PathError{Op: "decode", Path: p, Err: ErrInvalidName}
+			}
+		}
+	}
+	for _, fi := range dirs {
+		if err = checkNames(fsys, enc, filepath.Join(dir, fi.Name())); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// reencodeJournal is every move of a Reencode, split in steps that only start once the previous one is done.
+// no step renames anything over a path another rename of the same step moves away from,
+// so a rename whose source is gone is one that got done before an interruption.
+type reencodeJournal struct {
+	Step  int             `json:"step"` // the steps before it are done
+	Steps []*reencodeStep `json:"steps"`
+}
+
+type reencodeStep struct {
+	Renames  [][2]string                  `json:"renames,omitempty"`  // relative to the root of the database
+	LongKeys map[string]map[string]string `json:"longKeys,omitempty"` // bucket -> file name -> key, see keyFileName
+}
+
+// plan adds the moves that reencode b and its children.
+// each rename goes through a hidden name first, the new name of a key could be the old name of another one.
+// the keys move first, then the buckets, from the deepest up so the paths of their parents are still valid.
+func (j *reencodeJournal) plan(root *bucket, to KeyEncoder) (err error) {
+	var (
+		hide, show = &reencodeStep{}, &reencodeStep{}
+		metas      = &reencodeStep{LongKeys: map[string]map[string]string{}}
+		dirs       [][2]*reencodeStep // by depth
+	)
+	rel := func(path string) string {
+		p, _ := filepath.Rel(root.path, path)
+		return p
+	}
+
+	var walk func(b *bucket, depth int) error
+	walk = func(b *bucket, depth int) (err error) {
+		if err = b.rlock(); err != nil {
+			return
+		}
+		defer b.mux.RUnlock()
+
+		moved, longKeys := false, map[string]string{}
+		for _, key := range b.keys.Names(false) {
+			fi, _ := b.keys.Get(key)
+			fn := keyFileName(to, key)
+			if isLongKeyFile(fn) {
+				longKeys[fn] = key
+			}
+			if fn == fi.Name() {
+				continue
+			}
+			src, dst := b.filePath(fi.Name()), b.filePath(fn)
+			tmp := filepath.Join(filepath.Dir(dst), "."+fn+reencodeSuffix)
+			hide.Renames = append(hide.Renames, [2]string{rel(src), rel(tmp)})
+			show.Renames = append(show.Renames, [2]string{rel(tmp), rel(dst)})
+			moved = true
+		}
+		if moved && (len(longKeys) > 0 || len(b.meta.LongKeys) > 0) {
+			metas.LongKeys[rel(b.path)] = longKeys
+		}
+
+		names := make([]string, 0, len(b.buckets))
+		for name := range b.buckets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			cb := b.buckets[name]
+			if err = walk(cb, depth+1); err != nil {
+				return
+			}
+			fn := to.Encode(name)
+			dst := filepath.Join(b.path, fn)
+			if dst == cb.path {
+				continue
+			}
+			for len(dirs) <= depth {
+				dirs = append(dirs, [2]*reencodeStep{{}, {}})
+			}
+			tmp := filepath.Join(b.path, "."+fn+reencodeSuffix)
+			dirs[depth][0].Renames = append(dirs[depth][0].Renames, [2]string{rel(cb.path), rel(tmp)})
+			dirs[depth][1].Renames = append(dirs[depth][1].Renames, [2]string{rel(tmp), rel(dst)})
+		}
+		return
+	}
+	if err = walk(root, 0); err != nil {
+		return
+	}
+
+	if len(hide.Renames) > 0 {
+		j.Steps = append(j.Steps, hide, show)
+	}
+	if len(metas.LongKeys) > 0 {
+		j.Steps = append(j.Steps, metas)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if len(dirs[i][0].Renames) > 0 {
+			j.Steps = append(j.Steps, dirs[i][0], dirs[i][1])
+		}
+	}
+	return
+}
+
+// run does the steps that aren't done yet, recording its progress in the journal at jpath, and removes it once it's done.
+func (j *reencodeJournal) run(fsys FS, root, jpath string) (err error) {
+	for j.Step < len(j.Steps) {
+		if err = j.Steps[j.Step].run(fsys, root); err != nil {
+			return
+		}
+		j.Step++
+		var b []byte
+		if b, err = json.Marshal(j); err != nil {
+			return
+		}
+		if err = writeFileSync(fsys, jpath, b); err != nil {
+			return
+		}
+	}
+	// the expiry index has the old paths of the buckets, the next New rebuilds it
+	if err = fsys.Remove(filepath.Join(root, expiryIndexName)); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if err = fsys.Remove(jpath); err != nil {
+		return
+	}
+	return syncDir(fsys, root)
+}
+
+func (s *reencodeStep) run(fsys FS, root string) (err error) {
+	dirs := map[string]bool{}
+	for _, r := range s.Renames {
+		src, dst := filepath.Join(root, r[0]), filepath.Join(root, r[1])
+		if _, err = fsys.Stat(src); os.IsNotExist(err) { // done before an interruption
+			err = nil
+			continue
+		} else if err != nil {
+			return
+		}
+		if err = fsys.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return
+		}
+		if err = fsys.Rename(src, dst); err != nil {
+			return
+		}
+		dirs[filepath.Dir(src)], dirs[filepath.Dir(dst)] = true, true
+	}
+	for dir, longKeys := range s.LongKeys {
+		if err = replaceLongKeys(fsys, filepath.Join(root, dir, metaName), longKeys); err != nil {
+			return
+		}
+	}
+	for dir := range dirs {
+		if err = syncDir(fsys, dir); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// replaceLongKeys replaces the long keys in the metadata at path, leaving the rest of it alone.
+func replaceLongKeys(fsys FS, path string, longKeys map[string]string) (err error) {
+	m := map[string]json.RawMessage{}
+	if err = readJSONFile(fsys, path, &m); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	if len(longKeys) == 0 {
+		delete(m, "longKeys")
+	} else if m["longKeys"], err = json.Marshal(longKeys); err != nil {
+		return
+	}
+	var b []byte
+	if b, err = json.Marshal(m); err != nil {
+		return
+	}
+	return writeFileSync(fsys, path, b)
+}
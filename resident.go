@@ -0,0 +1,344 @@
+package iodb
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rlock read-locks the bucket, loading it first if it isn't loaded yet or got unloaded.
+func (b *bucket) rlock() error {
+	return b.rlockContext(context.Background())
+}
+
+// rlockContext is rlock, but it gives up waiting for the lock once ctx is done.
+func (b *bucket) rlockContext(ctx context.Context) error {
+	for {
+		if err := lockContext(ctx, b.mux.TryRLock, b.mux.RLock, b.mux.RUnlock); err != nil {
+			return err
+		}
+		if b.keys != nil {
+			b.db.resident.touch(b)
+			return nil
+		}
+		b.mux.RUnlock()
+
+		if err := b.lockContext(ctx); err != nil {
+			return err
+		}
+		b.mux.Unlock()
+	}
+}
+
+// lock locks the bucket, loading it first if it isn't loaded yet or got unloaded.
+func (b *bucket) lock() error {
+	return b.lockContext(context.Background())
+}
+
+// lockContext is lock, but it gives up waiting for the lock once ctx is done.
+func (b *bucket) lockContext(ctx context.Context) error {
+	if err := lockContext(ctx, b.mux.TryLock, b.mux.Lock, b.mux.Unlock); err != nil {
+		return err
+	}
+	if b.keys == nil {
+		if err := b.loadLocked(); err != nil {
+			b.keys, b.meta = nil, nil
+			b.mux.Unlock()
+			return err
+		}
+		b.db.resident.loaded(b)
+	}
+	b.db.resident.touch(b)
+	return nil
+}
+
+// lockWrite is lock for changes to keys and metadata, it holds DB.writes first so exports can't capture them half done.
+// it must be released with unlockWrite, and the caller must not hold another bucket lock or DB.writes already.
+func (b *bucket) lockWrite() error {
+	return b.lockWriteContext(context.Background())
+}
+
+// lockWriteContext is lockWrite, but it gives up waiting for the lock once ctx is done.
+func (b *bucket) lockWriteContext(ctx context.Context) error {
+	b.db.writes.RLock()
+	if err := b.lockContext(ctx); err != nil {
+		b.db.writes.RUnlock()
+		return err
+	}
+	return nil
+}
+
+func (b *bucket) unlockWrite() {
+	b.mux.Unlock()
+	b.db.writes.RUnlock()
+}
+
+// lockWritePair is lockWrite for moving keys from b to nb, the bucket locks are taken in the order of their paths,
+// like the path locks, so moves in opposite directions can't deadlock. it must be released with unlockWritePair.
+func (b *bucket) lockWritePair(nb *bucket) error {
+	if b == nb {
+		return b.lockWrite()
+	}
+	first, second := b, nb
+	if second.path < first.path {
+		first, second = second, first
+	}
+	b.db.writes.RLock()
+	if err := first.lock(); err != nil {
+		b.db.writes.RUnlock()
+		return err
+	}
+	if err := second.lock(); err != nil {
+		first.mux.Unlock()
+		b.db.writes.RUnlock()
+		return err
+	}
+	return nil
+}
+
+func (b *bucket) unlockWritePair(nb *bucket) {
+	if b != nb {
+		nb.mux.Unlock()
+	}
+	b.unlockWrite()
+}
+
+// loadLocked loads the metadata and keys of the bucket, it must be called with b.mux held.
+func (b *bucket) loadLocked() (err error) {
+	first := !b.opened.Load()
+	if first {
+		// only on the first load, once the bucket is in use there could be writes in progress.
+		if err = b.removeTempFiles(); err != nil {
+			return
+		}
+	}
+
+	var lost, corrupt bool
+	if lost, corrupt, err = b.openMeta(); err != nil {
+		return
+	}
+
+	if first {
+		// the layout can only change here, before anyone looked up a path.
+		if b.layout = b.meta.Layout; lost || b.db.opts.MigrateLayout {
+			b.layout = b.db.opts.Layout
+		}
+	}
+
+	if err = b.reload(); err != nil {
+		return
+	}
+
+	if lost {
+		if err = b.rebuildMeta(corrupt); err != nil {
+			return
+		}
+	}
+
+	if b.meta.Layout != b.layout {
+		b.meta.Layout = b.layout
+		if err = b.meta.store(); err != nil {
+			return
+		}
+	}
+
+	if exp := b.meta.BucketExpiry; exp != 0 && b.parent != nil {
+		b.db.expiry.ScheduleBucket(time.Unix(exp, 0), b)
+	}
+	if !b.meta.dirty { // otherwise the next store records it
+		b.db.expiries.set(b.path, b.meta.nextExpiry())
+	}
+
+	b.opened.Store(true)
+	return
+}
+
+// unloadLocked drops the keys and metadata of the bucket, they're reloaded on the next access.
+// it must be called with b.mux held, it returns false if the metadata had changes that couldn't be stored.
+func (b *bucket) unloadLocked() bool {
+	if b.flushMetaLocked() != nil {
+		return false
+	}
+	b.keys, b.meta = nil, nil
+	return true
+}
+
+func (b *bucket) logErr(op string, err error) {
+	log.Printf("iodb: error loading %s for %s: %v", b.path, op, err)
+}
+
+// residentSet unloads the least recently used buckets once there are more than max of them loaded.
+type residentSet struct {
+	lru  *list.List
+	elms map[*bucket]*list.Element
+	max  int
+	mux  sync.Mutex
+}
+
+func newResidentSet(max int) *residentSet {
+	return &residentSet{lru: list.New(), elms: map[*bucket]*list.Element{}, max: max}
+}
+
+func (rs *residentSet) touch(b *bucket) {
+	if rs.max <= 0 {
+		return
+	}
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	if e := rs.elms[b]; e != nil {
+		rs.lru.MoveToFront(e)
+	}
+	rs.trim(b) // catch up on buckets that were in use when they should have been unloaded
+}
+
+// loaded is called with b.mux held after loading b, and it unloads other buckets if needed.
+func (rs *residentSet) loaded(b *bucket) {
+	if rs.max <= 0 {
+		return
+	}
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	if rs.elms[b] == nil {
+		rs.elms[b] = rs.lru.PushFront(b)
+	}
+	rs.trim(b)
+}
+
+// trim unloads the least recently used buckets until there are at most max of them, rs.mux must be held.
+// buckets that are in use are skipped rather than waited for, since we might be the ones using them,
+// b is held by the caller.
+func (rs *residentSet) trim(b *bucket) {
+	for e := rs.lru.Back(); e != nil && rs.lru.Len() > rs.max; {
+		ob, prev := e.Value.(*bucket), e.Prev()
+		if ob != b && ob.mux.TryLock() {
+			if ob.unloadLocked() {
+				rs.lru.Remove(e)
+				delete(rs.elms, ob)
+			}
+			ob.mux.Unlock()
+		}
+		e = prev
+	}
+}
+
+// forget is called for deleted buckets.
+func (rs *residentSet) forget(b *bucket) {
+	if rs.max <= 0 {
+		return
+	}
+	rs.mux.Lock()
+	if e := rs.elms[b]; e != nil {
+		rs.lru.Remove(e)
+		delete(rs.elms, b)
+	}
+	rs.mux.Unlock()
+}
+
+// Len returns the number of loaded buckets, it's only tracked with MaxResidentBuckets set.
+func (rs *residentSet) Len() int {
+	rs.mux.Lock()
+	defer rs.mux.Unlock()
+	return rs.lru.Len()
+}
+
+// warmUp schedules the expiries of lazily loaded buckets in the background,
+// each bucket in the expiry index gets loaded once it has something due, without an index the whole tree gets walked
+// to build it.
+func (db *DB) warmUp() {
+	defer db.bg.Done()
+	if next, ok := db.expiries.entries(); ok {
+		for dir, ts := range next {
+			if b := db.root.openDir(dir); b != nil {
+				db.expiry.ScheduleLoad(time.Unix(ts, 0), b)
+			}
+		}
+		return
+	}
+
+	complete := true // every bucket got loaded, so they're all in the index
+	var walk func(b *bucket) bool
+	walk = func(b *bucket) bool {
+		select {
+		case <-db.closing:
+			return false
+		default:
+		}
+		if err := b.rlock(); err != nil {
+			b.logErr("warm up", err)
+			complete = false
+			return true
+		}
+		children := make([]*bucket, 0, len(b.buckets))
+		for _, cb := range b.buckets {
+			children = append(children, cb)
+		}
+		b.mux.RUnlock()
+		for _, cb := range children {
+			if !walk(cb) {
+				return false
+			}
+		}
+		return true
+	}
+	if !walk(db.root) || !complete {
+		return
+	}
+	if err := db.expiries.markComplete(); err != nil {
+		log.Printf("iodb: error storing the expiry index: %v", err)
+	}
+}
+
+// warm loads b if it isn't loaded already, which schedules the expiries of its keys.
+func (b *bucket) warm() {
+	if b.db.ops.begin() != nil {
+		return // closing, the next New schedules it again
+	}
+	defer b.db.ops.end()
+	if err := b.rlock(); err != nil {
+		b.logErr("warm up", err)
+		return
+	}
+	b.mux.RUnlock()
+}
+
+// openDir returns the bucket stored in dir, relative to b, without loading it or any bucket on the way,
+// or nil if there's no such bucket.
+func (b *bucket) openDir(dir string) *bucket {
+	if dir == "." {
+		return b
+	}
+	for _, fn := range strings.Split(dir, string(filepath.Separator)) {
+		if b = b.openChild(fn); b == nil {
+			return nil
+		}
+	}
+	return b
+}
+
+// openChild returns the child bucket stored in the directory fn without loading b, or nil if there's none.
+// the child is added to b.buckets, where loading b would have put it.
+func (b *bucket) openChild(fn string) *bucket {
+	name, err := b.db.decodeKey(fn)
+	if err != nil {
+		return nil
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if cb := b.buckets[name]; cb != nil {
+		return cb
+	}
+	if b.keys != nil { // loaded, so it would be there
+		return nil
+	}
+	path := filepath.Join(b.path, fn)
+	if fi, err := b.db.fs.Stat(path); err != nil || !fi.IsDir() {
+		return nil
+	}
+	cb := openBucket(b, name, path, b.db)
+	b.buckets[name] = cb
+	return cb
+}
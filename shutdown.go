@@ -0,0 +1,100 @@
+package iodb
+
+import (
+	"log"
+	"sync"
+)
+
+// opTracker counts in-flight operations and open readers so Close can wait for them.
+type opTracker struct {
+	n      int
+	closed bool
+	done   chan struct{} // closed once closed is set and n drops to 0
+	mux    sync.Mutex
+}
+
+func newOpTracker() *opTracker {
+	return &opTracker{done: make(chan struct{})}
+}
+
+// begin starts an operation, it returns ErrClosing once Close was called.
+func (t *opTracker) begin() error {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.closed {
+		return ErrClosing
+	}
+	t.n++
+	return nil
+}
+
+// add is begin for things started by an operation that's already in flight, like the readers it opens,
+// so it can't fail.
+func (t *opTracker) add() {
+	t.mux.Lock()
+	t.n++
+	t.mux.Unlock()
+}
+
+func (t *opTracker) end() {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if t.n--; t.n == 0 && t.closed {
+		select {
+		case <-t.done: // a reader opened by an operation that began before Close
+		default:
+			close(t.done)
+		}
+	}
+}
+
+// close stops new operations, the returned channel is closed once the in-flight ones are done.
+func (t *opTracker) close() <-chan struct{} {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	if !t.closed {
+		t.closed = true
+		if t.n == 0 {
+			close(t.done)
+		}
+	}
+	return t.done
+}
+
+// flushMeta stores the metadata of every loaded bucket that has changes that weren't stored yet.
+func (db *DB) flushMeta() error {
+	var walk func(b *bucket) error
+	walk = func(b *bucket) (err error) {
+		b.mux.Lock()
+		if b.meta != nil {
+			err = b.flushMetaLocked()
+		}
+		children := make([]*bucket, 0, len(b.buckets))
+		for _, cb := range b.buckets {
+			children = append(children, cb)
+		}
+		b.mux.Unlock()
+		if err != nil {
+			return
+		}
+		for _, cb := range children {
+			if err = walk(cb); err != nil {
+				return
+			}
+		}
+		return
+	}
+	return walk(db.root)
+}
+
+// flushMetaLocked stores the metadata if it has unstored changes, b.mux must be held.
+func (b *bucket) flushMetaLocked() error {
+	if !b.meta.dirty {
+		return nil
+	}
+	if err := b.meta.store(); err != nil {
+		log.Printf("iodb: error storing %s: %v", b.meta.path, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package iodb
+
+import "math/bits"
+
+// skipMaxLevel is enough for 4^32 keys, every level holds a quarter of the nodes of the one below it.
+const skipMaxLevel = 32
+
+// skiplist keeps strings sorted with O(log n) inserts, deletes and seeks,
+// so adding or removing a key doesn't move the rest of a large bucket's index around.
+type skiplist struct {
+	head  skipNode  // holds no key, head.next[i] is the first node of level i
+	tail  *skipNode // the last node, nil if the list is empty
+	level int       // the number of levels in use
+	n     int
+	rnd   uint64
+}
+
+type skipNode struct {
+	key  string
+	prev *skipNode // nil for the first node
+	next []*skipNode
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{head: skipNode{next: make([]*skipNode, skipMaxLevel)}, level: 1, rnd: 0x9e3779b97f4a7c15}
+}
+
+func (s *skiplist) Len() int { return s.n }
+
+// randomLevel returns the number of levels of a new node, xorshift is plenty and doesn't need a lock.
+func (s *skiplist) randomLevel() int {
+	s.rnd ^= s.rnd << 13
+	s.rnd ^= s.rnd >> 7
+	s.rnd ^= s.rnd << 17
+	lvl := 1 + bits.TrailingZeros64(s.rnd)/2
+	if lvl > skipMaxLevel {
+		lvl = skipMaxLevel
+	}
+	return lvl
+}
+
+// seek returns the first node >= key, or nil if there's none,
+// if update is set it gets the last node < key of every level, &s.head if there's none.
+func (s *skiplist) seek(key string, update *[skipMaxLevel]*skipNode) *skipNode {
+	x := &s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+// Insert adds key and returns true if it wasn't there already.
+func (s *skiplist) Insert(key string) bool {
+	var update [skipMaxLevel]*skipNode
+	if x := s.seek(key, &update); x != nil && x.key == key {
+		return false
+	}
+	lvl := s.randomLevel()
+	for ; s.level < lvl; s.level++ {
+		update[s.level] = &s.head
+	}
+	s.link(&skipNode{key: key, next: make([]*skipNode, lvl)}, &update)
+	return true
+}
+
+// link inserts x after the nodes in update.
+func (s *skiplist) link(x *skipNode, update *[skipMaxLevel]*skipNode) {
+	for i := range x.next {
+		x.next[i] = update[i].next[i]
+		update[i].next[i] = x
+	}
+	if update[0] != &s.head {
+		x.prev = update[0]
+	}
+	if x.next[0] != nil {
+		x.next[0].prev = x
+	} else {
+		s.tail = x
+	}
+	s.n++
+}
+
+// Delete removes key and returns true if it was there.
+func (s *skiplist) Delete(key string) bool {
+	var update [skipMaxLevel]*skipNode
+	x := s.seek(key, &update)
+	if x == nil || x.key != key {
+		return false
+	}
+	for i := range x.next {
+		update[i].next[i] = x.next[i]
+	}
+	if x.next[0] != nil {
+		x.next[0].prev = x.prev
+	} else {
+		s.tail = x.prev
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.n--
+	return true
+}
+
+// load fills an empty list with keys, which must be sorted and unique, without searching for where each one goes.
+func (s *skiplist) load(keys []string) {
+	var last [skipMaxLevel]*skipNode
+	for i := range last {
+		last[i] = &s.head
+	}
+	for _, key := range keys {
+		lvl := s.randomLevel()
+		if lvl > s.level {
+			s.level = lvl
+		}
+		x := &skipNode{key: key, next: make([]*skipNode, lvl)}
+		s.link(x, &last)
+		for i := range x.next {
+			last[i] = x
+		}
+	}
+}
+
+// first returns the first node, or nil if the list is empty.
+func (s *skiplist) first() *skipNode {
+	return s.head.next[0]
+}
+
+// last returns the last node, or nil if the list is empty.
+func (s *skiplist) last() *skipNode {
+	return s.tail
+}
+
+// ceil returns the first node >= key, or nil if there's none.
+func (s *skiplist) ceil(key string) *skipNode {
+	return s.seek(key, nil)
+}
+
+// below returns the last node < key, or nil if there's none.
+func (s *skiplist) below(key string) *skipNode {
+	if x := s.seek(key, nil); x != nil {
+		return x.prev
+	}
+	return s.tail
+}
@@ -0,0 +1,155 @@
+package iodb
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const snapshotDirName = ".snapshot"
+
+// snapshotFS wraps the FS of the database so files pinned by an export survive being removed or renamed over,
+// the first time one of them is about to change it gets linked, or copied if the FS can't, into the snapshot directory.
+// pins are only taken with the lock of the file's bucket held, which every writer holds while it removes or renames
+// key files, so a pinned path can't change between preserve and the operation that called it.
+type snapshotFS struct {
+	FS
+	dir  string
+	pins map[string]*pin
+	n    uint64
+	mux  sync.Mutex
+}
+
+// pin is a file an export still has to read.
+type pin struct {
+	path  string // the snapshot copy once the original had to be preserved
+	err   error  // set if preserving it failed, the export fails instead of the writer
+	refs  int
+	saved bool
+}
+
+// newSnapshotFS returns fsys wrapped in a snapshotFS that keeps its copies in dir,
+// anything left in dir by an unclean shutdown is removed.
+func newSnapshotFS(fsys FS, dir string) (*snapshotFS, error) {
+	if err := fsys.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	return &snapshotFS{FS: fsys, dir: dir, pins: map[string]*pin{}}, nil
+}
+
+// pin returns the pin of the file currently at path, it must be released with open or unpin.
+func (s *snapshotFS) pin(path string) *pin {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	p := s.pins[path]
+	if p == nil {
+		p = &pin{path: path}
+		s.pins[path] = p
+	}
+	p.refs++
+	return p
+}
+
+// open opens the pinned file and releases the pin.
+func (s *snapshotFS) open(p *pin) (f File, err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if err = p.err; err == nil {
+		f, err = s.FS.Open(p.path)
+	}
+	s.unpinLocked(p)
+	return
+}
+
+func (s *snapshotFS) unpin(p *pin) {
+	s.mux.Lock()
+	s.unpinLocked(p)
+	s.mux.Unlock()
+}
+
+func (s *snapshotFS) unpinLocked(p *pin) {
+	if p.refs--; p.refs > 0 {
+		return
+	}
+	if p.saved {
+		s.FS.Remove(p.path)
+	} else if s.pins[p.path] == p {
+		delete(s.pins, p.path)
+	}
+}
+
+// preserve saves the pinned files at path, or under it if all is set, before they get removed or replaced.
+func (s *snapshotFS) preserve(path string, all bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if len(s.pins) == 0 {
+		return
+	}
+	if p := s.pins[path]; p != nil {
+		s.save(p)
+	}
+	if !all {
+		return
+	}
+	prefix := path + string(filepath.Separator)
+	for pp, p := range s.pins {
+		if strings.HasPrefix(pp, prefix) {
+			s.save(p)
+		}
+	}
+}
+
+// save must be called with s.mux held.
+func (s *snapshotFS) save(p *pin) {
+	delete(s.pins, p.path)
+	s.n++
+	dst := filepath.Join(s.dir, strconv.FormatUint(s.n, 36))
+	if p.err = s.FS.MkdirAll(s.dir, 0o755); p.err != nil {
+		return
+	}
+	if l, ok := s.FS.(Linker); ok {
+		p.err = l.Link(p.path, dst)
+	} else {
+		p.err = copyFile(s.FS, p.path, dst)
+	}
+	if p.err == nil {
+		p.path, p.saved = dst, true
+	}
+}
+
+func (s *snapshotFS) Remove(name string) error {
+	s.preserve(name, false)
+	return s.FS.Remove(name)
+}
+
+// Rename only preserves pinned files under oldpath if it's renaming a file, iodb only renames directories while it's
+// opening or reencoding the database, when there can't be an export running.
+func (s *snapshotFS) Rename(oldpath, newpath string) error {
+	s.preserve(oldpath, false)
+	s.preserve(newpath, false)
+	return s.FS.Rename(oldpath, newpath)
+}
+
+func (s *snapshotFS) RemoveAll(path string) error {
+	s.preserve(path, true)
+	return s.FS.RemoveAll(path)
+}
+
+func copyFile(fsys FS, src, dst string) (err error) {
+	var in, out File
+	if in, err = fsys.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if out, err = fsys.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644); err != nil {
+		return
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return
+	}
+	return out.Close()
+}
@@ -0,0 +1,98 @@
+package iodb
+
+import (
+	"sync"
+	"time"
+)
+
+// SyncMode controls how hard iodb tries to make writes durable before returning.
+type SyncMode uint8
+
+const (
+	// SyncNone leaves flushing to the OS, a power loss can lose acknowledged writes.
+	SyncNone SyncMode = iota
+	// SyncData fsyncs files before they are renamed into place.
+	SyncData
+	// SyncFull is SyncData plus fsyncing the bucket directory after renames and deletes.
+	SyncFull
+	// SyncBatch is SyncFull, except concurrent writers to the same bucket share the directory fsyncs,
+	// at the cost of waiting up to Options.SyncBatchWindow.
+	SyncBatch
+)
+
+const defaultSyncBatchWindow = 2 * time.Millisecond
+
+// fsyncDir makes renames and deletes inside dir durable according to the SyncMode.
+// it must not be called while holding a bucket lock, or batching won't be able to batch anything.
+func (db *DB) fsyncDir(dir string) error {
+	switch db.opts.SyncMode {
+	case SyncFull:
+		return syncDir(db.fs, dir)
+	case SyncBatch:
+		return db.syncer.Sync(dir)
+	default:
+		return nil
+	}
+}
+
+// fsyncDirs is fsyncDir for every distinct dir, it's how changes to files in shard directories get synced
+// along with the bucket's directory, which has its .meta.
+func (db *DB) fsyncDirs(dirs ...string) error {
+next:
+	for i, dir := range dirs {
+		for _, d := range dirs[:i] {
+			if d == dir {
+				continue next
+			}
+		}
+		if err := db.fsyncDir(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newDirSyncer(fs FS, window time.Duration) *dirSyncer {
+	if window <= 0 {
+		window = defaultSyncBatchWindow
+	}
+	return &dirSyncer{fs: fs, window: window, pending: map[string]*syncBatch{}}
+}
+
+// dirSyncer implements group commit for directory fsyncs.
+type dirSyncer struct {
+	fs      FS
+	pending map[string]*syncBatch
+	window  time.Duration
+	mux     sync.Mutex
+}
+
+type syncBatch struct {
+	err  error
+	done chan struct{}
+}
+
+// Sync blocks until dir has been fsynced by a batch that started after the call.
+func (ds *dirSyncer) Sync(dir string) error {
+	ds.mux.Lock()
+	sb := ds.pending[dir]
+	if sb == nil {
+		sb = &syncBatch{done: make(chan struct{})}
+		ds.pending[dir] = sb
+		time.AfterFunc(ds.window, func() { ds.flush(dir, sb) })
+	}
+	ds.mux.Unlock()
+
+	<-sb.done
+	return sb.err
+}
+
+func (ds *dirSyncer) flush(dir string, sb *syncBatch) {
+	// once the batch is out of pending, nobody can join it, so the fsync covers everyone that did.
+	ds.mux.Lock()
+	delete(ds.pending, dir)
+	ds.mux.Unlock()
+
+	sb.err = syncDir(ds.fs, dir)
+	close(sb.done)
+}
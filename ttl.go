@@ -0,0 +1,552 @@
+package iodb
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// NoTTL is returned by TTL for keys that don't expire.
+const NoTTL time.Duration = -1
+
+// TTL returns how long key has left before it expires, or NoTTL if it doesn't expire.
+// expiry dates are stored with a second precision, so it can be up to a second shorter than what was set.
+func (b *bucket) TTL(key string) (_ time.Duration, err error) {
+	defer b.wrapErr("TTL", key, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.db.checkKey(key); err != nil {
+		return
+	}
+	if err = b.rlock(); err != nil {
+		return
+	}
+	defer b.mux.RUnlock()
+	if _, ok := b.keys.Get(key); !ok {
+		return 0, ErrNotFound
+	}
+	exp := b.meta.ExpiryDate[key]
+	if exp == 0 {
+		return NoTTL, nil
+	}
+	if d := time.Until(time.Unix(exp, 0)); d > 0 {
+		return d, nil
+	}
+	return 0, nil
+}
+
+// Expire sets key to expire after d without touching its value, d <= 0 is the same as Persist.
+func (b *bucket) Expire(key string, d time.Duration) error {
+	if d <= 0 {
+		return b.updateExpiry("Expire", key, time.Time{}, 0)
+	}
+	return b.updateExpiry("Expire", key, time.Now().Add(d), 0)
+}
+
+// ExpireAt sets key to expire at t, a time in the past expires it right away and a zero t is the same as Persist.
+func (b *bucket) ExpireAt(key string, t time.Time) error {
+	return b.updateExpiry("ExpireAt", key, t, 0)
+}
+
+// ExpireSliding sets key to expire after d, and every Get pushes the expiry d into the future again.
+// d <= 0 is the same as Persist.
+func (b *bucket) ExpireSliding(key string, d time.Duration) error {
+	if d <= 0 {
+		return b.updateExpiry("ExpireSliding", key, time.Time{}, 0)
+	}
+	return b.updateExpiry("ExpireSliding", key, time.Now().Add(d), d)
+}
+
+// Persist removes the expiry of key.
+func (b *bucket) Persist(key string) error {
+	return b.updateExpiry("Persist", key, time.Time{}, 0)
+}
+
+func (b *bucket) updateExpiry(op, key string, at time.Time, sliding time.Duration) (err error) {
+	defer b.wrapErr(op, key, &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if err = b.db.checkKey(key); err != nil {
+		return
+	}
+	defer func() { // registered first so it runs after the lock is released
+		if err == nil {
+			err = b.db.fsyncDir(b.path)
+		}
+	}()
+
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	defer b.unlockWrite()
+
+	if _, ok := b.keys.Get(key); !ok {
+		return ErrNotFound
+	}
+
+	b.setExpiryAt(key, at)
+	b.meta.SetSliding(key, sliding)
+	b.meta.SetChanged(key)
+	return b.meta.store()
+}
+
+// slideExpiry pushes the expiry of a sliding key another window into the future,
+// the metadata is only stored when the expiry moves by at least a second.
+func (b *bucket) slideExpiry(key string, window time.Duration) (err error) {
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	if _, ok := b.keys.Get(key); !ok || b.meta.Sliding[key] != int64(window) {
+		// deleted or changed since the caller checked
+		b.unlockWrite()
+		return
+	}
+
+	now := time.Now()
+	if exp := b.meta.ExpiryDate[key]; exp != 0 && exp <= now.Unix() {
+		// already expired, it's up to the scheduler now
+		b.unlockWrite()
+		return
+	}
+
+	at := now.Add(window)
+	if at.Unix() == b.meta.ExpiryDate[key] {
+		b.unlockWrite()
+		return
+	}
+
+	b.meta.SetExpiryDate(key, at.Unix())
+	b.db.expiry.Schedule(at, b, key)
+	err = b.meta.store()
+	b.unlockWrite()
+
+	if err == nil {
+		err = b.db.fsyncDir(b.path)
+	}
+	return
+}
+
+const defaultExpiryRetry = time.Minute
+
+// ExpireFunc is called with the value of an expired key, see ExpiryPolicy.
+type ExpireFunc func(key string, extra map[string]string, r io.Reader) error
+
+// ExpiryPolicy controls what happens to the keys of a bucket once they expire.
+type ExpiryPolicy struct {
+	// OnExpire is called before an expired key is deleted or archived, r is the stored value without any middleware applied.
+	// returning an error keeps the key around and retries after RetryAfter.
+	// it runs on the expiry goroutine, so it holds up all other expiries until it returns, and it must not write to the key.
+	// it isn't stored, so keys of non-archiving buckets that expired while the db was closed are deleted without calling it.
+	OnExpire ExpireFunc
+	// Archive is the path of the bucket expired keys are moved to instead of being deleted, it's created if needed.
+	// archived keys keep their extra data but not their expiry, it is stored in the bucket metadata.
+	Archive []string
+	// RetryAfter is how long to wait before retrying a failed OnExpire or archive, defaults to a minute.
+	RetryAfter time.Duration
+}
+
+// SetExpiryPolicy replaces the expiry policy of the bucket, the zero value restores the default of deleting expired keys.
+func (b *bucket) SetExpiryPolicy(p ExpiryPolicy) (err error) {
+	defer b.wrapErr("SetExpiryPolicy", "", &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if len(p.Archive) > 0 {
+		var ab Bucket
+		if ab, err = b.db.root.CreateBucket(p.Archive...); err != nil {
+			return
+		}
+		if ab.(*bucket) == b {
+			return ErrSamePath
+		}
+	}
+
+	defer func() { // registered first so it runs after the lock is released
+		if err == nil {
+			err = b.db.fsyncDir(b.path)
+		}
+	}()
+
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	defer b.unlockWrite()
+
+	b.onExpire, b.retryAfter = p.OnExpire, p.RetryAfter
+	if sameNames(b.meta.Archive, p.Archive) {
+		return
+	}
+	b.meta.Archive = append([]string(nil), p.Archive...)
+	return b.meta.store()
+}
+
+// ExpiryPolicy returns the current expiry policy of the bucket.
+func (b *bucket) ExpiryPolicy() ExpiryPolicy {
+	if err := b.rlock(); err != nil {
+		b.logErr("ExpiryPolicy", err)
+		return ExpiryPolicy{}
+	}
+	defer b.mux.RUnlock()
+	return ExpiryPolicy{
+		OnExpire:   b.onExpire,
+		Archive:    append([]string(nil), b.meta.Archive...),
+		RetryAfter: b.retryAfter,
+	}
+}
+
+// expired must be called with b.mux held.
+func (b *bucket) expired(key string, now int64) bool {
+	exp := b.meta.ExpiryDate[key]
+	return exp != 0 && exp <= now
+}
+
+// deleteTimed is called by the expiry scheduler, the key is only deleted if it's still expired,
+// it could have been overwritten or had its expiry changed since it got scheduled.
+func (b *bucket) deleteTimed(key string) {
+	if b.db.ops.begin() != nil {
+		return // closing, the next New schedules it again
+	}
+	defer b.db.ops.end()
+	if err := b.lockWrite(); err != nil {
+		b.logErr("expiring "+key, err)
+		return
+	}
+	fi, ok := b.keys.Get(key)
+	if !ok || !b.expired(key, time.Now().Unix()) {
+		b.unlockWrite()
+		return
+	}
+
+	var (
+		onExpire = b.onExpire
+		archive  = b.meta.Archive
+		retry    = b.retryAfter
+	)
+
+	if onExpire == nil && len(archive) == 0 {
+		path := b.filePath(fi.Name())
+		b.db.fs.Remove(path)
+		b.nukeKey(key)
+		b.files.Delete(path)
+		b.unlockWrite()
+
+		b.db.fsyncDirs(filepath.Dir(path), b.path)
+		return
+	}
+	b.unlockWrite()
+
+	if err := b.expireKey(key, fi.Name(), onExpire, archive); err != nil {
+		if retry <= 0 {
+			retry = defaultExpiryRetry
+		}
+		log.Printf("iodb: error expiring %s (%s), retrying in %v: %v", key, b.path, retry, err)
+		b.db.expiry.Schedule(time.Now().Add(retry), b, key)
+	}
+}
+
+// expireKey applies the expiry policy to key, fn is its file name.
+func (b *bucket) expireKey(key, fn string, onExpire ExpireFunc, archive []string) (err error) {
+	var ab *bucket
+	if len(archive) > 0 {
+		var nb Bucket
+		if nb, err = b.db.root.CreateBucket(archive...); err != nil {
+			return
+		}
+		ab = nb.(*bucket)
+	}
+
+	path := b.filePath(fn)
+	if onExpire != nil {
+		if err = b.callOnExpire(key, path, onExpire); err != nil {
+			return
+		}
+	}
+
+	if ab == nil {
+		return b.removeExpired(key, path)
+	}
+	nPath, err := ab.prepareFile(fn)
+	if err != nil {
+		return
+	}
+	return b.archiveExpired(key, path, ab, nPath)
+}
+
+func (b *bucket) callOnExpire(key, path string, onExpire ExpireFunc) (err error) {
+	defer b.db.lk.RLock(path).RUnlock()
+
+	var rd *Reader
+	if rd, err = b.files.Get(path); err != nil {
+		return
+	}
+	defer rd.Close()
+
+	if err = b.rlock(); err != nil {
+		return
+	}
+	extra := b.meta.CopyExtra(key)
+	b.mux.RUnlock()
+
+	return onExpire(key, extra, rd)
+}
+
+func (b *bucket) removeExpired(key, path string) (err error) {
+	defer func() { // registered first so it runs after all the locks are released
+		if err == nil {
+			err = b.db.fsyncDirs(filepath.Dir(path), b.path)
+		}
+	}()
+
+	defer b.db.lk.Lock(path).Unlock()
+
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	defer b.unlockWrite()
+
+	if _, ok := b.keys.Get(key); !ok || !b.expired(key, time.Now().Unix()) {
+		return // changed while OnExpire was running
+	}
+
+	if err = b.db.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	b.nukeKey(key)
+	b.files.Delete(path)
+	return b.meta.store()
+}
+
+func (b *bucket) archiveExpired(key, path string, ab *bucket, nPath string) (err error) {
+	defer func() { // registered first so it runs after all the locks are released
+		if err == nil {
+			err = b.db.fsyncDirs(filepath.Dir(path), b.path, filepath.Dir(nPath), ab.path)
+		}
+	}()
+
+	// in the same order as everything else that moves files between buckets, a rename from ab back to b included
+	defer b.db.lk.LockPair(path, nPath)()
+
+	if err = b.lockWritePair(ab); err != nil {
+		return
+	}
+	defer b.unlockWritePair(ab)
+
+	if _, ok := b.keys.Get(key); !ok || !b.expired(key, time.Now().Unix()) {
+		return // changed while OnExpire was running
+	}
+
+	if err = b.db.fs.Rename(path, nPath); err != nil {
+		return
+	}
+
+	var st os.FileInfo
+	if st, err = b.db.fs.Stat(nPath); err != nil {
+		return
+	}
+
+	extra := b.meta.Extra[key]
+	b.nukeKey(key)
+	b.files.Delete(path)
+
+	if _, ok := ab.keys.Get(key); !ok {
+		ab.meta.incCounter()
+	}
+	ab.setKey(key, st)
+	ab.meta.SetChanged(key) // renames keep the modification time
+	ab.files.Delete(nPath)
+	ab.setExpiryAt(key, time.Time{})
+	delete(ab.meta.Extra, key)
+	for k, v := range extra {
+		ab.meta.SetExtraData(key, k, v)
+	}
+
+	if err = b.meta.store(); err != nil {
+		return
+	}
+	return ab.meta.store()
+}
+
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// moveExpiry moves the expiry of key to nKey in nb, replacing the one nKey had, both buckets must be locked.
+func (b *bucket) moveExpiry(key string, nb *bucket, nKey string) {
+	exp, sliding := b.meta.ExpiryDate[key], b.meta.Sliding[key]
+	b.setExpiryAt(key, time.Time{})
+	if exp == 0 {
+		nb.setExpiryAt(nKey, time.Time{})
+		return
+	}
+	nb.setExpiryAt(nKey, time.Unix(exp, 0))
+	nb.meta.SetSliding(nKey, time.Duration(sliding))
+}
+
+// putTTL returns the expiry of a write, 0 means the bucket's default TTL.
+// it must be called with b.mux held.
+func (b *bucket) putTTL(expireAfter time.Duration) time.Duration {
+	if expireAfter == 0 {
+		return time.Duration(b.meta.DefaultTTL)
+	}
+	return expireAfter
+}
+
+// SetDefaultTTL sets the expiry of keys written without one, d <= 0 removes it.
+// it only applies to writes that happen after it's set.
+func (b *bucket) SetDefaultTTL(d time.Duration) (err error) {
+	defer b.wrapErr("SetDefaultTTL", "", &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if d < 0 {
+		d = 0
+	}
+
+	defer func() { // registered first so it runs after the lock is released
+		if err == nil {
+			err = b.db.fsyncDir(b.path)
+		}
+	}()
+
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	defer b.unlockWrite()
+	if b.meta.DefaultTTL == int64(d) {
+		return
+	}
+	b.meta.DefaultTTL = int64(d)
+	return b.meta.store()
+}
+
+// DefaultTTL returns the expiry of keys written without one, 0 means they don't expire.
+func (b *bucket) DefaultTTL() time.Duration {
+	if err := b.rlock(); err != nil {
+		b.logErr("DefaultTTL", err)
+		return 0
+	}
+	defer b.mux.RUnlock()
+	return time.Duration(b.meta.DefaultTTL)
+}
+
+// ExpireBucket sets the bucket to be deleted after d, d <= 0 removes the expiry.
+func (b *bucket) ExpireBucket(d time.Duration) error {
+	if d <= 0 {
+		return b.ExpireBucketAt(time.Time{})
+	}
+	return b.ExpireBucketAt(time.Now().Add(d))
+}
+
+// ExpireBucketAt sets the bucket to be deleted at t, a zero t removes the expiry.
+// the keys of an expired bucket are deleted with it, without going through its expiry policy.
+func (b *bucket) ExpireBucketAt(t time.Time) (err error) {
+	defer b.wrapErr("ExpireBucket", "", &err)
+	if err = b.db.ops.begin(); err != nil {
+		return
+	}
+	defer b.db.ops.end()
+	if b.parent == nil {
+		return ErrRootBucket
+	}
+
+	defer func() { // registered first so it runs after the lock is released
+		if err == nil {
+			err = b.db.fsyncDir(b.path)
+		}
+	}()
+
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	defer b.unlockWrite()
+	if t.IsZero() {
+		b.meta.BucketExpiry = 0
+		b.db.expiry.CancelBucket(b)
+	} else {
+		b.meta.BucketExpiry = t.Unix()
+		b.db.expiry.ScheduleBucket(t, b)
+	}
+	return b.meta.store()
+}
+
+// BucketTTL returns how long the bucket has left before it expires, or NoTTL if it doesn't expire.
+func (b *bucket) BucketTTL() time.Duration {
+	if err := b.rlock(); err != nil {
+		b.logErr("BucketTTL", err)
+		return NoTTL
+	}
+	defer b.mux.RUnlock()
+	exp := b.meta.BucketExpiry
+	if exp == 0 {
+		return NoTTL
+	}
+	if d := time.Until(time.Unix(exp, 0)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// deleteExpired is called by the expiry scheduler to delete an expired bucket.
+func (b *bucket) deleteExpired() {
+	if b.db.ops.begin() != nil {
+		return // closing, the next New schedules it again
+	}
+	defer b.db.ops.end()
+	if err := b.rlock(); err != nil {
+		b.logErr("expiring the bucket", err)
+		return
+	}
+	exp := b.meta.BucketExpiry
+	b.mux.RUnlock()
+	if exp == 0 || time.Now().Unix() < exp {
+		return
+	}
+
+	p := b.parent
+	if err := p.rlock(); err != nil {
+		p.logErr("expiring "+b.name, err)
+		return
+	}
+	cb := p.buckets[b.name]
+	p.mux.RUnlock()
+	if cb != b { // already deleted
+		return
+	}
+
+	if err := p.DeleteBucket(b.name); err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("iodb: error deleting expired bucket %s: %v", b.path, err)
+	}
+}
+
+// forget removes b and its children from the expiry schedule, the expiry index and the resident set once they're deleted.
+func (b *bucket) forget() {
+	b.db.expiry.Forget(b)
+	b.db.resident.forget(b)
+	b.db.expiries.forget(b.path)
+	b.mux.RLock()
+	children := make([]*bucket, 0, len(b.buckets))
+	for _, cb := range b.buckets {
+		children = append(children, cb)
+	}
+	b.mux.RUnlock()
+	for _, cb := range children {
+		cb.forget()
+	}
+}
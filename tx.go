@@ -0,0 +1,432 @@
+package iodb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/alpineiq/iodb/mw"
+)
+
+const (
+	txDirName      = ".txn"
+	txJournalName  = "journal"
+	txProgressName = "progress"
+)
+
+const (
+	txOpPut    = "put"
+	txOpDelete = "delete"
+	txOpRename = "rename"
+	txOpExpire = "expire"
+	txOpExtra  = "extra"
+)
+
+var txCounter uint64
+
+// Tx stages changes across any number of buckets, nothing is visible until the transaction commits.
+// A Tx is only valid inside the function passed to DB.Update and must not be used concurrently.
+type Tx struct {
+	db     *DB
+	dir    string
+	ops    []txOp
+	exists map[string]bool // staged view of which keys exist
+}
+
+type txOp struct {
+	Op       string   `json:"op"`
+	Bucket   []string `json:"bucket,omitempty"`
+	Key      string   `json:"key,omitempty"`
+	Staged   string   `json:"staged,omitempty"`
+	NBucket  []string `json:"nBucket,omitempty"`
+	NKey     string   `json:"nKey,omitempty"`
+	Expiry   int64    `json:"expiry,omitempty"` // unix nano, 0 means the bucket's default ttl and -1 no expiry
+	ExtraKey string   `json:"extraKey,omitempty"`
+	Value    string   `json:"value,omitempty"`
+	Existed  bool     `json:"existed,omitempty"` // the key of a put existed when it was staged
+}
+
+type txJournal struct {
+	Ops []txOp `json:"ops"`
+}
+
+// Update runs fn inside a transaction, if fn returns nil all the staged changes are committed atomically,
+// otherwise they are discarded.
+// Changes are written to a journal before they are applied, if the process crashes while applying them,
+// the next call to New will finish the job, if it crashes before the journal is written, nothing is applied.
+// Transactions don't isolate readers from partially applied changes.
+func (db *DB) Update(fn func(tx *Tx) error) (err error) {
+	if err = db.ops.begin(); err != nil {
+		return
+	}
+	defer db.ops.end()
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(atomic.AddUint64(&txCounter, 1), 36)
+	tx := &Tx{
+		db:     db,
+		dir:    filepath.Join(db.root.path, txDirName, id),
+		exists: map[string]bool{},
+	}
+	if err = db.fs.MkdirAll(tx.dir, 0o755); err != nil {
+		return
+	}
+	committed := false
+	defer func() { // also cleans up if fn panics
+		if !committed {
+			db.fs.RemoveAll(tx.dir)
+		}
+	}()
+
+	if err = fn(tx); err != nil || len(tx.ops) == 0 {
+		return
+	}
+
+	db.txMux.Lock()
+	defer db.txMux.Unlock()
+
+	var j []byte
+	if j, err = json.Marshal(&txJournal{Ops: tx.ops}); err != nil {
+		return
+	}
+	if err = writeFileSync(db.fs, filepath.Join(tx.dir, txJournalName), j); err != nil {
+		return
+	}
+	committed = true
+
+	// once the journal is written, the transaction is committed, if applying it fails
+	// the journal is left behind so the next New can replay it.
+	return db.applyTx(tx.dir, tx.ops, 0, false)
+}
+
+// Bucket returns a handle to stage changes on the bucket with the specified path,
+// the bucket is created on commit if it doesn't exist.
+func (tx *Tx) Bucket(names ...string) *TxBucket {
+	return &TxBucket{tx: tx, names: names}
+}
+
+func (tx *Tx) keyExists(names []string, key string) bool {
+	if ok, staged := tx.exists[txKeyID(names, key)]; staged {
+		return ok
+	}
+	b, _ := tx.db.root.Bucket(names...).(*bucket)
+	if b == nil {
+		return false
+	}
+	_, err := b.Stat(key)
+	return err == nil
+}
+
+// check rejects everything that would make applying an op fail no matter how many times it's replayed.
+func (tx *Tx) check(names []string, key string) error {
+	for _, name := range names {
+		if err := tx.db.checkName(name); err != nil {
+			return err
+		}
+	}
+	return tx.db.checkKey(key)
+}
+
+func (tx *Tx) stage(op txOp, fn func(w io.Writer) error, mws []mw.Middleware) (err error) {
+	var (
+		name = strconv.Itoa(len(tx.ops))
+		path = filepath.Join(tx.dir, name)
+		f    File
+		wc   io.WriteCloser
+	)
+	if f, err = tx.db.fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644); err != nil {
+		return
+	}
+	if wc, err = middlewareList(mws).applyWriters(path, syncCloser{f}); err != nil {
+		return
+	}
+	if err = fn(wc); err != nil {
+		wc.Close()
+		return
+	}
+	if err = wc.Close(); err != nil {
+		return
+	}
+	op.Staged, op.Existed = name, tx.keyExists(op.Bucket, op.Key)
+	tx.ops = append(tx.ops, op)
+	tx.exists[txKeyID(op.Bucket, op.Key)] = true
+	return
+}
+
+func txKeyID(names []string, key string) string {
+	return strings.Join(names, "\x00") + "\x00\x00" + key
+}
+
+// TxBucket stages changes to a single bucket inside a transaction.
+type TxBucket struct {
+	tx    *Tx
+	names []string
+}
+
+func (tb *TxBucket) Put(key string, r io.Reader, middlewares ...mw.Middleware) error {
+	fn := func(w io.Writer) error { _, err := io.Copy(w, r); return err }
+	return tb.PutTimedFunc(key, fn, 0, middlewares...)
+}
+
+func (tb *TxBucket) PutFunc(key string, fn func(w io.Writer) error, middlewares ...mw.Middleware) error {
+	return tb.PutTimedFunc(key, fn, 0, middlewares...)
+}
+
+func (tb *TxBucket) PutTimed(key string, r io.Reader, expireAfter time.Duration, middlewares ...mw.Middleware) error {
+	fn := func(w io.Writer) error { _, err := io.Copy(w, r); return err }
+	return tb.PutTimedFunc(key, fn, expireAfter, middlewares...)
+}
+
+func (tb *TxBucket) PutTimedFunc(key string, fn func(w io.Writer) error, expireAfter time.Duration, middlewares ...mw.Middleware) error {
+	if err := tb.tx.check(tb.names, key); err != nil { // validate the key before doing any work
+		return err
+	}
+	return tb.tx.stage(txOp{Op: txOpPut, Bucket: tb.names, Key: key, Expiry: txExpiry(expireAfter)}, fn, middlewares)
+}
+
+func (tb *TxBucket) Delete(key string) error {
+	if err := tb.tx.check(tb.names, key); err != nil {
+		return err
+	}
+	if !tb.tx.keyExists(tb.names, key) {
+		return ErrNotFound
+	}
+	tb.tx.ops = append(tb.tx.ops, txOp{Op: txOpDelete, Bucket: tb.names, Key: key})
+	tb.tx.exists[txKeyID(tb.names, key)] = false
+	return nil
+}
+
+// Rename moves key to nKey in nb, if nb is nil, the key is renamed inside the same bucket.
+func (tb *TxBucket) Rename(key string, nb *TxBucket, nKey string) error {
+	if nb == nil {
+		nb = tb
+	}
+	if nb.tx != tb.tx {
+		return ErrInvalidBucketType
+	}
+	if err := tb.tx.check(tb.names, key); err != nil {
+		return err
+	}
+	if err := tb.tx.check(nb.names, nKey); err != nil {
+		return err
+	}
+	if txKeyID(tb.names, key) == txKeyID(nb.names, nKey) {
+		return ErrSamePath
+	}
+	if !tb.tx.keyExists(tb.names, key) {
+		return ErrNotFound
+	}
+	tb.tx.ops = append(tb.tx.ops, txOp{Op: txOpRename, Bucket: tb.names, Key: key, NBucket: nb.names, NKey: nKey})
+	tb.tx.exists[txKeyID(tb.names, key)] = false
+	tb.tx.exists[txKeyID(nb.names, nKey)] = true
+	return nil
+}
+
+// Expire changes the expiry of key, expireAfter <= 0 removes it.
+func (tb *TxBucket) Expire(key string, expireAfter time.Duration) error {
+	if err := tb.tx.check(tb.names, key); err != nil {
+		return err
+	}
+	if !tb.tx.keyExists(tb.names, key) {
+		return ErrNotFound
+	}
+	tb.tx.ops = append(tb.tx.ops, txOp{Op: txOpExpire, Bucket: tb.names, Key: key, Expiry: txExpiry(expireAfter)})
+	return nil
+}
+
+// SetExtraData sets extra meta data on the specified file, an empty val deletes it.
+func (tb *TxBucket) SetExtraData(fileKey, key, val string) error {
+	if err := tb.tx.check(tb.names, fileKey); err != nil {
+		return err
+	}
+	if !tb.tx.keyExists(tb.names, fileKey) {
+		return ErrNotFound
+	}
+	tb.tx.ops = append(tb.tx.ops, txOp{Op: txOpExtra, Bucket: tb.names, Key: fileKey, ExtraKey: key, Value: val})
+	return nil
+}
+
+func txExpiry(expireAfter time.Duration) int64 {
+	if expireAfter < 0 {
+		return -1
+	}
+	if expireAfter == 0 {
+		return 0
+	}
+	return time.Now().Add(expireAfter).UnixNano()
+}
+
+func (op *txOp) expireAfter() time.Duration {
+	if op.Expiry <= 0 {
+		return time.Duration(op.Expiry) // 0 and NoTTL mean the same thing to commitFile and setExpiry
+	}
+	if d := time.Until(time.Unix(0, op.Expiry)); d > 0 {
+		return d
+	}
+	return time.Nanosecond // already expired, let the timer clean it up
+}
+
+// applyTx applies ops[from:], recording its progress so a crash never applies an op twice.
+// when replaying, ops that fail are added to the recovery report and skipped, trying them again
+// on the next New would most likely fail the same way.
+// the caller must hold db.txMux.
+func (db *DB) applyTx(dir string, ops []txOp, from int, replay bool) (err error) {
+	for i := from; i < len(ops); i++ {
+		if err = db.applyTxOp(dir, &ops[i]); err != nil {
+			if !replay {
+				return
+			}
+			log.Printf("iodb: transaction %s: %s op %d failed: %v", filepath.Base(dir), ops[i].Op, i, err)
+			db.recovery.add(&db.recovery.FailedTxnOps, filepath.Base(dir)+"/"+strconv.Itoa(i)+": "+err.Error())
+		}
+		if err = writeFileSync(db.fs, filepath.Join(dir, txProgressName), []byte(strconv.Itoa(i+1))); err != nil {
+			return
+		}
+	}
+	return db.fs.RemoveAll(dir)
+}
+
+func (db *DB) applyTxOp(dir string, op *txOp) (err error) {
+	var bkt Bucket
+	if bkt, err = db.root.CreateBucket(op.Bucket...); err != nil {
+		return
+	}
+	b := bkt.(*bucket)
+
+	switch op.Op {
+	case txOpPut:
+		src := filepath.Join(dir, op.Staged)
+		if _, err = db.fs.Stat(src); os.IsNotExist(err) { // already moved in place before a crash
+			return b.replayPutMeta(op)
+		}
+		var path string
+		if path, err = b.prepareFile(db.keyFileName(op.Key)); err != nil {
+			return
+		}
+		if err = func() error {
+			defer db.lk.Lock(path).Unlock()
+			return b.commitFile(context.Background(), op.Key, src, path, op.expireAfter())
+		}(); err != nil {
+			return
+		}
+		return db.fsyncDirs(filepath.Dir(path), b.path)
+
+	case txOpDelete:
+		return ignoreNotExist(b.Delete(op.Key))
+
+	case txOpRename:
+		var nb Bucket
+		if nb, err = db.root.CreateBucket(op.NBucket...); err != nil {
+			return
+		}
+		return ignoreNotExist(b.Rename(op.Key, nb, op.NKey))
+
+	case txOpExpire:
+		if err = b.lockWrite(); err != nil {
+			return
+		}
+		if _, ok := b.keys.Get(op.Key); ok {
+			b.setExpiry(op.Key, op.expireAfter())
+			b.meta.SetChanged(op.Key)
+			err = b.meta.store()
+		}
+		b.unlockWrite()
+		if err != nil {
+			return
+		}
+		return db.fsyncDir(b.path)
+
+	case txOpExtra:
+		return ignoreNotExist(b.SetExtraData(op.Key, op.ExtraKey, op.Value))
+	}
+
+	return nil
+}
+
+// replayPutMeta applies the metadata half of a put whose file got moved in place before a crash,
+// the crash might have happened before commitFile stored the metadata.
+// if it happened after, the counter gets increased twice, which only skips an id.
+func (b *bucket) replayPutMeta(op *txOp) (err error) {
+	if err = b.lockWrite(); err != nil {
+		return
+	}
+	fi, ok := b.keys.Get(op.Key)
+	if ok {
+		if !op.Existed {
+			b.meta.incCounter()
+		}
+		b.setExpiry(op.Key, b.putTTL(op.expireAfter()))
+		b.meta.SetChanged(op.Key)
+		err = b.meta.store()
+	}
+	b.unlockWrite()
+	if err != nil || !ok {
+		return
+	}
+	return b.db.fsyncDirs(filepath.Dir(b.filePath(fi.Name())), b.path)
+}
+
+// recoverTxns replays committed transactions and discards the ones that never got committed.
+// a transaction that can't be replayed is reported and left for the next New, it doesn't keep the db from opening.
+func (db *DB) recoverTxns() (err error) {
+	root := filepath.Join(db.root.path, txDirName)
+	des, err := db.fs.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	db.txMux.Lock()
+	defer db.txMux.Unlock()
+
+	for _, de := range des {
+		dir := filepath.Join(root, de.Name())
+		if !de.IsDir() {
+			db.fs.Remove(dir)
+			continue
+		}
+
+		var j txJournal
+		if err = readJSONFile(db.fs, filepath.Join(dir, txJournalName), &j); err != nil {
+			if os.IsNotExist(err) { // never committed
+				if err = db.fs.RemoveAll(dir); err != nil {
+					return
+				}
+				db.recovery.add(&db.recovery.RolledBackTxns, de.Name())
+				continue
+			}
+			log.Printf("iodb: transaction %s: %v", de.Name(), err)
+			db.recovery.add(&db.recovery.FailedTxnOps, de.Name()+": "+err.Error())
+			continue
+		}
+
+		var from int
+		if p, perr := readFile(db.fs, filepath.Join(dir, txProgressName)); perr == nil {
+			from, _ = strconv.Atoi(string(p))
+		}
+		if err = db.applyTx(dir, j.Ops, from, true); err != nil {
+			log.Printf("iodb: transaction %s: %v", de.Name(), err)
+			db.recovery.add(&db.recovery.FailedTxnOps, de.Name()+": "+err.Error())
+			continue
+		}
+		db.recovery.add(&db.recovery.ReplayedTxns, de.Name())
+	}
+
+	return nil
+}
+
+func ignoreNotExist(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}